@@ -4,10 +4,17 @@ package main
 import (
 	"os"
 	"fmt"
+	"flag"
 	"time"
+	"context"
+	"strconv"
+	"syscall"
+	"net/http"
 	"runtime"
+	"os/signal"
 	"runtime/pprof"
 	server "github.com/avsolo/gache/server"
+	storage "github.com/avsolo/gache/storage"
 	ll "github.com/avsolo/gache/lib"
 	// "github.com/pkg/profile"
 )
@@ -19,8 +26,24 @@ func init() {
 }
 
 func main() {
-	if ll.CliParams.CpuProf != "" {
-		f, err := os.Create(ll.CliParams.CpuProf)
+	cfg, err := ll.LoadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fmt.Printf("Can't load config. Error: %s\n", err.Error())
+		return
+	}
+	if err := ll.ConfigureLog(cfg); err != nil {
+		fmt.Printf("Can't configure log. Error: %s\n", err.Error())
+		return
+	}
+	if cfg.HashPassword != "" {
+		fmt.Println(server.HashPassword(cfg.HashPassword))
+		return
+	}
+	if cfg.CpuProf != "" {
+		f, err := os.Create(cfg.CpuProf)
 		if err != nil {
 			fmt.Printf("Can't open profiler file. Error: %s\n", err.Error())
 			return
@@ -35,30 +58,170 @@ func main() {
 		// Not working on OS X
 		// defer profile.Start(
 			// profile.CPUProfile,
-			// profile.ProfilePath(ll.CliParams.ProfDir)).Stop()
+			// profile.ProfilePath(cfg.ProfDir)).Stop()
 
 	} else {
 		fmt.Printf("Profile disabled\n")
 	}
 
-	// Sample func for stopping app after N sec
-	if ll.CliParams.ExitOn > 0 {
-		fmt.Printf("Exit after %d sec\n", ll.CliParams.ExitOn)
+	policy, err := storage.ParseEvictionPolicy(cfg.EvictionPolicy)
+	if err != nil {
+		fmt.Printf("Bad eviction policy: %s\n", cfg.EvictionPolicy)
+		return
+	}
+	st, err := settings(cfg)
+	if err != nil {
+		fmt.Printf("Can't load ACL file. Error: %s\n", err.Error())
+		return
+	}
+	srv := server.NewServer(cfg.ServerAddr,
+		server.WithDatabases(cfg.Databases,
+			storage.WithTickInterval(cfg.TickInterval),
+			storage.WithMaxMemory(int64(cfg.MaxMemory) << 20),
+			storage.WithEvictionPolicy(policy),
+			storage.WithCompression(cfg.CompressThreshold)),
+		server.WithKeepAlive(cfg.KeepAlive),
+		server.WithSettings(st))
+	perm, err := strconv.ParseUint(cfg.SocketPerm, 8, 32)
+	if err != nil {
+		fmt.Printf("Bad socket permissions: %s\n", cfg.SocketPerm)
+		return
+	}
+	srv.SocketPerm = os.FileMode(perm)
+	if cfg.TLSCert != "" {
+		tlsConfig, err := server.ServerTLSConfig(cfg.TLSCert,
+			cfg.TLSKey, cfg.TLSClientCA)
+		if err != nil {
+			fmt.Printf("Can't load TLS certificate. Error: %s\n", err.Error())
+			return
+		}
+		srv.TLSConfig = tlsConfig
+	}
+
+	var metrics *http.Server
+	if cfg.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", srv.MetricsHandler())
+		metrics = &http.Server{Addr: cfg.MetricsAddr, Handler: mux}
 		go func() {
-			t := time.Now().Unix() + int64(ll.CliParams.ExitOn)
-			for {
-				c := time.Now().Unix()
-				if c >= t {
-					fmt.Printf("Exit\n")
-					os.Exit(0)
-				}
-				time.Sleep(time.Duration(1) * time.Second)
+			if err := metrics.ListenAndServe(); err != http.ErrServerClosed {
+				fmt.Printf("Metrics server error: %s\n", err.Error())
 			}
 		}()
+	}
+
+	go reload(cfg, srv)
+
+	// Stop server gracefully on signal or after N sec
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		waitStop(cfg.ExitOn)
+		fmt.Printf("Shutting down\n")
+		timeout := time.Duration(cfg.ShutdownTimeout) * time.Second
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if metrics != nil {
+			metrics.Shutdown(ctx)
+		}
+		if err := srv.Shutdown(ctx); err != nil {
+			fmt.Printf("Shutdown error: %s\n", err.Error())
+		}
+	}()
+
+	if err := srv.ListenTCP(); err != server.ErrServerClosed {
+		fmt.Printf("Server error: %s\n", err.Error())
+		return
+	}
+	<-stopped
+	fmt.Printf("Exit\n")
+}
+
+// settings makes server settings from config loading ACL file and adding
+// default user if password required
+func settings(cfg *ll.Config) (server.Settings, error) {
+	st := server.Settings{
+		IdleTimeout: cfg.IdleTimeout,
+		ReadTimeout: cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		MaxLineLength: cfg.MaxLineLength,
+		MaxConns: cfg.MaxConns,
+		MaxConnsPerIP: cfg.MaxConnsPerIP,
+		RateLimit: cfg.RateLimit,
+		RateBurst: cfg.RateBurst,
+		RateLimitBy: cfg.RateLimitBy,
+		SlowLogThreshold: cfg.SlowLogThreshold,
+		SlowLogMax: cfg.SlowLogMax,
+	}
+	if cfg.ACLFile != "" {
+		acl, err := server.LoadACL(cfg.ACLFile)
+		if err != nil {
+			return st, err
+		}
+		st.ACL = acl
+	}
+	if cfg.RequirePass != "" {
+		if st.ACL == nil {
+			st.ACL = server.NewACL()
+		}
+		st.ACL.AddUser(server.NewDefaultUser(cfg.RequirePass))
+	}
+	return st, nil
+}
+
+// reload reloads config on SIGHUP and applies log settings, timeouts,
+// limits, slow log settings, ACL, max memory and eviction policy. Other
+// settings (address, TLS, number of databases) require restart
+func reload(cfg *ll.Config, srv *server.Server) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		fmt.Printf("Reloading config\n")
+		next, err := cfg.Reload()
+		if err != nil {
+			fmt.Printf("Can't reload config. Error: %s\n", err.Error())
+			continue
+		}
+		st, err := settings(next)
+		if err != nil {
+			fmt.Printf("Can't load ACL file. Error: %s\n", err.Error())
+			continue
+		}
+		policy, err := storage.ParseEvictionPolicy(next.EvictionPolicy)
+		if err != nil {
+			fmt.Printf("Bad eviction policy: %s\n", next.EvictionPolicy)
+			continue
+		}
+		if err := ll.ConfigureLog(next); err != nil {
+			fmt.Printf("Can't configure log. Error: %s\n", err.Error())
+			continue
+		}
+		srv.Reload(st)
+		for _, db := range srv.Databases() {
+			db.SetMaxMemory(int64(next.MaxMemory) << 20)
+			db.SetEvictionPolicy(policy)
+			db.SetCompression(next.CompressThreshold)
+		}
+	}
+}
+
+// waitStop blocks till SIGINT or SIGTERM received or exitOn sec passed
+// if exitOn is positive
+func waitStop(exitOn int) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	var timer <-chan time.Time
+	if exitOn > 0 {
+		fmt.Printf("Exit after %d sec\n", exitOn)
+		timer = time.After(time.Duration(exitOn) * time.Second)
 	} else {
 		fmt.Printf("Running forever\n")
 	}
-
-	srv := server.NewServer(ll.CliParams.ServerAddr)
-	srv.ListenTCP()
+	select {
+	case s := <-sig:
+		fmt.Printf("Got signal: %s\n", s)
+	case <-timer:
+	}
 }
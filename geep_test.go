@@ -1,28 +1,39 @@
 package main
 
 import (
+	"os"
 	"fmt"
 	"time"
 	"testing"
+	"path/filepath"
 	"github.com/avsolo/gache/lib"
 	"github.com/avsolo/gache/server"
 )
 
 var _s = fmt.Sprintf
 var log *lib.Logger
-var addr = lib.CliParams.ServerAddr
+var addr = lib.NewConfig().ServerAddr
 var srv = server.NewServer(addr)
 var cln *server.Client
 
+// Servers to compare TCP and Unix socket transports
+var tcpAddr = "127.0.0.1:8801"
+var unixAddr = server.UnixPrefix + filepath.Join(os.TempDir(), "gache_bench.sock")
+
 func init() {
 	log = lib.NewLogger("benchmark")
     go func() {
         srv.ListenTCP()
         log.Info("Server stopped")
     }()
+    for _, a := range []string{tcpAddr, unixAddr} {
+        s := server.NewServer(a)
+        s.KeepAlive = true
+        go s.ListenTCP()
+    }
     // Sometimest client trying connect before server start.
     // So, we just wait a bit
-    time.Sleep(time.Duration(100 * time.Microsecond))
+    time.Sleep(time.Duration(100 * time.Millisecond))
     cln = server.NewClient(addr)
 }
 
@@ -95,3 +106,28 @@ func BenchmarkDSetDAdd(b *testing.B) {
 		}
 	}
 }
+
+// benchSetGet runs SET and GET through kept alive connection to addr
+func benchSetGet(b *testing.B, addr string) {
+	c := server.NewClient(addr)
+	c.KeepAlive = true
+	defer c.Close()
+	c.Send("OPT flush")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Send(fmt.Sprintf("SET k%d somevalue 100", i)); err != nil {
+			panic("Unable make reqeust. Error: " + err.Error())
+		}
+		if _, err := c.Send(fmt.Sprintf("GET k%d", i)); err != nil {
+			panic(err.Error())
+		}
+	}
+}
+
+func BenchmarkSetGetTCP(b *testing.B) {
+	benchSetGet(b, tcpAddr)
+}
+
+func BenchmarkSetGetUnix(b *testing.B) {
+	benchSetGet(b, unixAddr)
+}
@@ -2,29 +2,212 @@
 package lib
 
 import (
+	"os"
+	"fmt"
 	"flag"
+	"time"
+	"bufio"
+	"errors"
+	"strings"
+	"path/filepath"
 )
 
-type cliParams struct {
+// EnvPrefix is prefix of environment variables overriding config file,
+// e.g. GACHE_RATE_LIMIT sets -rate-limit
+const EnvPrefix = "GACHE_"
+
+// ErrBadConfig returns when config file line can't be parsed
+var ErrBadConfig = errors.New("Bad config line")
+
+// Config keeps gache settings. It's loaded by LoadConfig from (in order of
+// priority) command line flags, environment variables and config file.
+// NewConfig returns Config with defaults
+type Config struct {
+	ConfigFile string
 	ServerAddr string
 	LogEnable bool
 	LogLevel int
 	LogPath string
+	LogFormat string
+	LogMaxSize int
 	CpuProf string
 	ProfDir string
 	ExitOn int
+	Databases int
+	MaxMemory int
+	EvictionPolicy string
+	CompressThreshold int
+	TickInterval time.Duration
+	KeepAlive bool
+	ShutdownTimeout int
+	IdleTimeout time.Duration
+	ReadTimeout time.Duration
+	WriteTimeout time.Duration
+	MaxLineLength int
+	MaxConns int
+	MaxConnsPerIP int
+	RateLimit float64
+	RateBurst int
+	RateLimitBy string
+	RequirePass string
+	ACLFile string
+	HashPassword string
+	TLSCert string
+	TLSKey string
+	TLSClientCA string
+	SocketPerm string
+	MetricsAddr string
+	SlowLogThreshold time.Duration
+	SlowLogMax int
+	args []string // Command line used by Reload
+}
+
+// NewConfig returns Config with default values
+func NewConfig() *Config {
+	c := &Config{}
+	c.flagSet(flag.ContinueOnError)
+	return c
 }
 
-var CliParams *cliParams = &cliParams{}
+// LoadConfig parses command line args (without program name). If config
+// file set with -config, it's loaded first, then environment variables
+// applied. Flags set in args override both of them
+func LoadConfig(args []string) (*Config, error) {
+	c := &Config{args: args}
+	fs := c.flagSet(flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
 
-func init() {
-	flag.StringVar(&CliParams.ServerAddr, "addr", "127.0.0.1:8800", "Address to use by server")
-	flag.BoolVar(&CliParams.LogEnable, "log", false, "Log on/off")
-	flag.IntVar(&CliParams.LogLevel, "log-level", 1, "Log level [1-5]")
-	flag.StringVar(&CliParams.LogPath, "log-path", "", "Path to logs dir")
-	flag.StringVar(&CliParams.CpuProf, "cpu-prof", "", "Path to cpu.pprof file")
-	flag.StringVar(&CliParams.CpuProf, "prof-dir", "", "Path to profile directory")
-	flag.IntVar(&CliParams.ExitOn, "exit-on", 0, "Automatically stop app after N sec")
-	flag.Parse()
+	if c.ConfigFile != "" {
+		values, err := readConfigFile(c.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range values {
+			if set[kv[0]] {
+				continue
+			}
+			if err := fs.Set(kv[0], kv[1]); err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", c.ConfigFile, kv[0], err)
+			}
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		v, found := os.LookupEnv(EnvName(f.Name))
+		if !found || set[f.Name] || err != nil {
+			return
+		}
+		if e := fs.Set(f.Name, v); e != nil {
+			err = fmt.Errorf("%s: %v", EnvName(f.Name), e)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload loads config again with the same command line, so changes of
+// config file and environment are applied
+func (c *Config) Reload() (*Config, error) {
+	return LoadConfig(c.args)
 }
 
+// EnvName returns environment variable name for flag name
+func EnvName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// flagSet registers all flags bound to Config fields. Registering sets
+// default values
+func (c *Config) flagSet(h flag.ErrorHandling) *flag.FlagSet {
+	fs := flag.NewFlagSet("gache", h)
+	fs.StringVar(&c.ConfigFile, "config", "", "Path to flat config file (key: value or, for .toml, key = value lines with flag names as keys)")
+	fs.StringVar(&c.ServerAddr, "addr", "127.0.0.1:8800", "Address to use by server (IP:PORT or unix:///path.sock)")
+	fs.StringVar(&c.SocketPerm, "socket-perm", "0660", "Permissions of Unix socket file (octal)")
+	fs.BoolVar(&c.LogEnable, "log", false, "Log on/off")
+	fs.IntVar(&c.LogLevel, "log-level", 1, "Log level [1-5]")
+	fs.StringVar(&c.LogPath, "log-path", "", "Path to logs dir")
+	fs.StringVar(&c.LogFormat, "log-format", "text", "Log format [text|json]")
+	fs.IntVar(&c.LogMaxSize, "log-max-size", 100, "Max size of log file in MB before rotation (0 - unlimited)")
+	fs.StringVar(&c.CpuProf, "cpu-prof", "", "Path to cpu.pprof file")
+	fs.StringVar(&c.ProfDir, "prof-dir", "", "Path to profile directory")
+	fs.IntVar(&c.ExitOn, "exit-on", 0, "Automatically stop app after N sec")
+	fs.IntVar(&c.Databases, "databases", 16, "Number of databases")
+	fs.IntVar(&c.MaxMemory, "max-memory", 0, "Max memory of one database in MB (0 - unlimited)")
+	fs.IntVar(&c.CompressThreshold, "compress-threshold", 0, "Min size in bytes of compressed values (0 - disabled)")
+	fs.StringVar(&c.EvictionPolicy, "eviction-policy", "noeviction", "Keys deleted on max memory [noeviction|allkeys-lru|allkeys-random|volatile-lru|volatile-ttl]")
+	fs.DurationVar(&c.TickInterval, "tick-interval", time.Second, "Interval of deleting expired keys")
+	fs.IntVar(&c.ShutdownTimeout, "shutdown-timeout", 10, "Seconds to wait for commands in progress on shutdown")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", 5 * time.Minute, "Close connection idle longer than this (0 - never)")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", 10 * time.Second, "Max time of reading one request (0 - unlimited)")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", 10 * time.Second, "Max time of writing one response (0 - unlimited)")
+	fs.IntVar(&c.MaxLineLength, "max-line", 1 << 20, "Max request length in bytes (0 - unlimited)")
+	fs.IntVar(&c.MaxConns, "max-conns", 0, "Max number of client connections (0 - unlimited)")
+	fs.IntVar(&c.MaxConnsPerIP, "max-conns-ip", 0, "Max number of connections from one IP (0 - unlimited)")
+	fs.Float64Var(&c.RateLimit, "rate-limit", 0, "Commands per second allowed (0 - unlimited)")
+	fs.IntVar(&c.RateBurst, "rate-burst", 10, "Commands allowed at once over rate limit")
+	fs.StringVar(&c.RateLimitBy, "rate-limit-by", "conn", "Apply rate limit per connection or per IP [conn|ip]")
+	fs.StringVar(&c.RequirePass, "requirepass", "", "Password required by AUTH for default user")
+	fs.StringVar(&c.ACLFile, "acl-file", "", "Path to ACL file with users")
+	fs.StringVar(&c.HashPassword, "hash-password", "", "Print hash of password for ACL file and exit")
+	fs.StringVar(&c.TLSCert, "tls-cert", "", "Path to TLS certificate, enables TLS")
+	fs.StringVar(&c.TLSKey, "tls-key", "", "Path to TLS certificate key")
+	fs.StringVar(&c.TLSClientCA, "tls-client-ca", "", "Path to CA certificates verifying client certificates (mutual TLS)")
+	fs.StringVar(&c.MetricsAddr, "metrics-addr", "", "Address of HTTP listener serving Prometheus metrics at /metrics")
+	fs.DurationVar(&c.SlowLogThreshold, "slowlog-threshold", 10 * time.Millisecond, "Min duration of command saved in slow log (0 - disabled)")
+	fs.IntVar(&c.SlowLogMax, "slowlog-max", 128, "Max number of slow log entries")
+	fs.BoolVar(&c.KeepAlive, "keep-alive", false, "Keep client connections open between requests")
+	return fs
+}
+
+// readConfigFile reads flat config file. Files with .toml extension use
+// "key = value" lines, others are YAML with "key: value" lines. Keys are
+// flag names, "_" can be used instead of "-". Values can be quoted. Lines
+// started with # are comments
+func readConfigFile(path string) ([][2]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sep := ":"
+	if filepath.Ext(path) == ".toml" {
+		sep = "="
+	}
+	values := [][2]string{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+		kv := strings.SplitN(line, sep, 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, ErrBadConfig)
+		}
+		key := strings.Replace(strings.TrimSpace(kv[0]), "_", "-", -1)
+		values = append(values, [2]string{key, configValue(kv[1])})
+	}
+	return values, sc.Err()
+}
+
+// configValue strips trailing comment and quotes of value
+func configValue(v string) string {
+	v = strings.TrimSpace(v)
+	if len(v) > 1 && (v[0] == '"' || v[0] == '\'') {
+		if end := strings.IndexByte(v[1:], v[0]); end >= 0 {
+			return v[1 : end+1]
+		}
+	}
+	if i := strings.Index(v, " #"); i >= 0 {
+		v = strings.TrimSpace(v[:i])
+	}
+	return v
+}
@@ -0,0 +1,93 @@
+package lib
+
+import (
+	"os"
+	"testing"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, name, data string) string {
+	dir, _ := ioutil.TempDir("", "gache_config")
+	path := filepath.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(path, []byte(data), 0666))
+	return path
+}
+
+func TestNewConfig(t *testing.T) {
+	c := NewConfig()
+	assert.Equal(t, "127.0.0.1:8800", c.ServerAddr)
+	assert.Equal(t, 16, c.Databases)
+	assert.Equal(t, 5 * time.Minute, c.IdleTimeout)
+}
+
+func TestLoadConfigYAML(t *testing.T) {
+	path := writeConfig(t, "gache.yml", `---
+# Server
+addr: "127.0.0.1:9900"
+max_conns: 10 # Comment
+slowlog-threshold: 5ms
+keep-alive: true
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	c, err := LoadConfig([]string{"-config", path})
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:9900", c.ServerAddr)
+	assert.Equal(t, 10, c.MaxConns)
+	assert.Equal(t, 5 * time.Millisecond, c.SlowLogThreshold)
+	assert.True(t, c.KeepAlive)
+	assert.Equal(t, 16, c.Databases)
+}
+
+func TestLoadConfigTOML(t *testing.T) {
+	path := writeConfig(t, "gache.toml", "log_format = 'json'\nrate-limit = 2.5\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	c, err := LoadConfig([]string{"-config", path})
+	assert.Nil(t, err)
+	assert.Equal(t, "json", c.LogFormat)
+	assert.Equal(t, 2.5, c.RateLimit)
+
+	path = writeConfig(t, "bad.toml", "max-conns\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	_, err = LoadConfig([]string{"-config", path})
+	assert.NotNil(t, err)
+
+	path = writeConfig(t, "unknown.toml", "no-such-flag = 1\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	_, err = LoadConfig([]string{"-config", path})
+	assert.NotNil(t, err)
+}
+
+func TestLoadConfigPriority(t *testing.T) {
+	path := writeConfig(t, "gache.yml", "max-conns: 10\nmax-conns-ip: 2\ndatabases: 4\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	assert.Equal(t, "GACHE_MAX_CONNS_IP", EnvName("max-conns-ip"))
+	os.Setenv("GACHE_MAX_CONNS", "20")
+	os.Setenv("GACHE_MAX_CONNS_IP", "3")
+	defer os.Unsetenv("GACHE_MAX_CONNS")
+	defer os.Unsetenv("GACHE_MAX_CONNS_IP")
+
+	// Flags override env, env overrides file
+	c, err := LoadConfig([]string{"-config", path, "-max-conns", "30"})
+	assert.Nil(t, err)
+	assert.Equal(t, 30, c.MaxConns)
+	assert.Equal(t, 3, c.MaxConnsPerIP)
+	assert.Equal(t, 4, c.Databases)
+
+	// Reload applies changes of file and env
+	ioutil.WriteFile(path, []byte("databases: 8\n"), 0666)
+	os.Setenv("GACHE_MAX_CONNS_IP", "5")
+	c, err = c.Reload()
+	assert.Nil(t, err)
+	assert.Equal(t, 30, c.MaxConns)
+	assert.Equal(t, 5, c.MaxConnsPerIP)
+	assert.Equal(t, 8, c.Databases)
+
+	os.Setenv("GACHE_MAX_CONNS_IP", "x")
+	_, err = LoadConfig(nil)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,74 @@
+package lib
+
+import (
+	"fmt"
+	"bytes"
+	"strings"
+	"encoding/json"
+)
+
+// Encoder converts log entry to bytes written to Output
+type Encoder interface {
+	Encode(e *Entry) []byte
+}
+
+// TextEncoder writes entries as
+//      15:04:05 | INFO  | server | server.go:72 | Message key=value
+type TextEncoder struct{}
+
+// Encode implements Encoder
+func (TextEncoder) Encode(e *Entry) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s | %s | %s | %s | %s", e.Time.Format("15:04:05"),
+		level[e.Level], e.Logger, e.Caller, e.Msg)
+	for _, f := range e.Fields {
+		v := fmt.Sprint(f.Value)
+		if strings.ContainsAny(v, " \"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		fmt.Fprintf(&b, " %s=%s", f.Key, v)
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// JSONEncoder writes entries as one JSON object per line with time, level,
+// logger, caller and msg keys followed by fields
+type JSONEncoder struct{}
+
+// Encode implements Encoder
+func (JSONEncoder) Encode(e *Entry) []byte {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	writeJSON(&b, "time", e.Time.Format("2006-01-02T15:04:05.000Z07:00"))
+	b.WriteByte(',')
+	writeJSON(&b, "level", strings.ToLower(strings.TrimSpace(level[e.Level])))
+	b.WriteByte(',')
+	writeJSON(&b, "logger", e.Logger)
+	b.WriteByte(',')
+	writeJSON(&b, "caller", e.Caller)
+	b.WriteByte(',')
+	writeJSON(&b, "msg", e.Msg)
+	for _, f := range e.Fields {
+		b.WriteByte(',')
+		writeJSON(&b, f.Key, f.Value)
+	}
+	b.WriteString("}\n")
+	return b.Bytes()
+}
+
+// writeJSON writes "key":value. Values which can't be marshaled (and
+// errors) are written as strings
+func writeJSON(b *bytes.Buffer, key string, v interface{}) {
+	k, _ := json.Marshal(key)
+	b.Write(k)
+	b.WriteByte(':')
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(data)
+}
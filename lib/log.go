@@ -2,13 +2,14 @@
 package lib
 
 import (
+	"io"
 	"os"
 	"fmt"
+	"sync"
 	"time"
 	"runtime"
 	"strings"
 	"path/filepath"
-	logging "log"
 )
 
 const (
@@ -17,9 +18,10 @@ const (
 	LOG_WARN = 3
 	LOG_ERROR = 4
 	LOG_FATAL = 5
+	LOG_OFF = 6
 )
 
-var log *Logger
+var log = NewLogger("lib")
 var level map[int]string = map[int]string{
 	LOG_DEBUG: "DEBUG",
 	LOG_INFO:  "INFO ",
@@ -27,128 +29,267 @@ var level map[int]string = map[int]string{
 	LOG_ERROR: "ERROR",
 	LOG_FATAL: "FATAL",
 }
-var logLevel int = 1
-var logEnable bool = true
-var logOut = os.Stdout
 
-type Logger struct {
-	Log *logging.Logger
-	IsEnabled bool
-	Level int
-	Path string
-	BasePath string
+// LoggerInterface is logger used by storage and server packages. It's
+// implemented by Logger and can be implemented by any application logger
+// to inject it with storage.SetLogger and server.SetLogger. Methods with w
+// suffix take message and key/value pairs of structured fields
+type LoggerInterface interface {
+	Debugf(s string, args ...interface{})
+	Infof(s string, args ...interface{})
+	Warnf(s string, args ...interface{})
+	Errorf(s string, args ...interface{})
+	Debugw(msg string, kv ...interface{})
+	Infow(msg string, kv ...interface{})
+	Warnw(msg string, kv ...interface{})
+	Errorw(msg string, kv ...interface{})
+}
+
+// Field is key/value pair added to log entry
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Entry is one log record passed to Encoder
+type Entry struct {
+	Time   time.Time
+	Level  int
+	Logger string // Logger name
+	Caller string // file:line
+	Msg    string
+	Fields []Field
+}
+
+// Output is destination of log entries shared by loggers. It keeps writer,
+// encoder and minimal level of entries
+type Output struct {
+	lock  sync.Mutex
+	w     io.Writer
+	enc   Encoder
+	level int
 }
 
-func NewLogger(p string) *Logger {
-	var err error
-	if log != nil {
-		return log
+// NewOutput creates Output writing entries with level or higher to w
+func NewOutput(w io.Writer, enc Encoder, level int) *Output {
+	return &Output{w: w, enc: enc, level: level}
+}
+
+// defaultOutput used by loggers made by NewLogger. It's disabled till
+// configured with ConfigureLog or Configure
+var defaultOutput = NewOutput(os.Stdout, TextEncoder{}, LOG_OFF)
+
+// DefaultOutput returns Output used by loggers made by NewLogger
+func DefaultOutput() *Output {
+	return defaultOutput
+}
+
+// Configure replaces writer, encoder and level of Output. Nil w or enc
+// are left unchanged
+func (o *Output) Configure(w io.Writer, enc Encoder, level int) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if w != nil {
+		o.w = w
 	}
-	if CliParams.LogPath != "" {
-		cpath := CliParams.LogPath
-		d := time.Now().Format("2006-01-02")
-		var absPath string
-		if strings.HasPrefix(cpath, "/") {
-			absPath, err = filepath.Abs(cpath)
-		} else {
-			realPath := filepath.Join(filepath.Base("."),  cpath)
-			absPath, err = filepath.Abs(filepath.Join(realPath))
-		}
-		if err != nil {
-			log.Fatalf("Path to log wrong: %v\n", err)
-		}
-		path, err := filepath.Abs(filepath.Join(absPath, d + "_geep-server.log"))
-		if err == nil {
-			os.Remove(path)
-		}
-		f, err := os.OpenFile(path, os.O_APPEND | os.O_WRONLY | os.O_CREATE, 0666)
-		if err != nil {
-			fmt.Printf("Unable open log file: %v\n", err)
-		}
-		log = &Logger{ Log: logging.New(f, "", logging.Ltime) }
-		// log.Log.SetOutput(f) // Not working on Linux (but working on OS X!)
-	} else {
-		buf := *os.Stdout
-		log = &Logger{ Log: logging.New(&buf, "", logging.Ltime) }
+	if enc != nil {
+		o.enc = enc
 	}
+	o.level = level
+}
 
-	log.BasePath, err = filepath.Abs(".")
-	if err != nil {
-		fmt.Printf("Unable open log file: %v\n", err)
+// enabled checks that entries of level t are written
+func (o *Output) enabled(t int) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return t >= o.level
+}
+
+func (o *Output) write(e *Entry) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if e.Level < o.level {
+		return
 	}
-	log.BasePath = strings.ToLower(log.BasePath) + "/"
-	log.IsEnabled = CliParams.LogEnable
-	log.Level = CliParams.LogLevel
-	return log
+	o.w.Write(o.enc.Encode(e))
 }
 
-func getLogPath(s string) *os.File {
-	d := time.Now().Format("2006-01-02")
-	path := filepath.Join(s, d + "_geep-server.log")
-	f, err := os.OpenFile(path, os.O_RDWR | os.O_CREATE | os.O_APPEND, 0666)
-	if err != nil {
-		log.Fatalf("error opening file: %v", err)
+// Logger is named logger with optional fields added to every entry
+type Logger struct {
+	name   string
+	fields []Field
+	out    *Output
+}
+
+// NewLogger creates logger named by component (e.g. "server") writing to
+// DefaultOutput
+func NewLogger(name string) *Logger {
+	return &Logger{name: name, out: defaultOutput}
+}
+
+// NewLoggerOutput creates logger writing to out
+func NewLoggerOutput(name string, out *Output) *Logger {
+	return &Logger{name: name, out: out}
+}
+
+// Named returns child logger named "parent.name"
+func (l *Logger) Named(name string) *Logger {
+	if l.name != "" {
+		name = l.name + "." + name
 	}
-	return f
+	return &Logger{name: name, fields: l.fields, out: l.out}
+}
+
+// With returns child logger adding key/value pairs to every entry
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := append(append([]Field{}, l.fields...), toFields(kv)...)
+	return &Logger{name: l.name, fields: fields, out: l.out}
+}
+
+// Name returns logger name
+func (l *Logger) Name() string {
+	return l.name
 }
 
 // Debug
 func (l *Logger) Debug(s string) {
-	l.print(LOG_DEBUG, s)
+	l.log(LOG_DEBUG, s, nil)
 }
 func (l *Logger) Debugf(s string, args ...interface{}) {
-	l.printf(LOG_DEBUG, s, args...)
+	l.logf(LOG_DEBUG, s, args...)
+}
+func (l *Logger) Debugw(msg string, kv ...interface{}) {
+	l.log(LOG_DEBUG, msg, kv)
 }
 
 // Info
 func (l *Logger) Info(s string) {
-	l.print(LOG_INFO, s)
+	l.log(LOG_INFO, s, nil)
 }
 func (l *Logger) Infof(s string, args ...interface{}) {
-	l.printf(LOG_INFO, s, args...)
+	l.logf(LOG_INFO, s, args...)
+}
+func (l *Logger) Infow(msg string, kv ...interface{}) {
+	l.log(LOG_INFO, msg, kv)
 }
 
 // Warn
 func (l *Logger) Warn(s string) {
-	l.printf(LOG_WARN, s)
+	l.log(LOG_WARN, s, nil)
 }
 func (l *Logger) Warnf(s string, args ...interface{}) {
-	l.printf(LOG_WARN, s, args...)
+	l.logf(LOG_WARN, s, args...)
+}
+func (l *Logger) Warnw(msg string, kv ...interface{}) {
+	l.log(LOG_WARN, msg, kv)
 }
 
 // Error
 func (l *Logger) Error(s string) {
-	l.printf(LOG_ERROR, s)
+	l.log(LOG_ERROR, s, nil)
 }
 func (l *Logger) Errorf(s string, args ...interface{}) {
-	l.printf(LOG_ERROR, s, args...)
+	l.logf(LOG_ERROR, s, args...)
+}
+func (l *Logger) Errorw(msg string, kv ...interface{}) {
+	l.log(LOG_ERROR, msg, kv)
 }
 
 // Fatal
 func (l *Logger) Fatal(s string) {
-	l.printf(LOG_FATAL, s)
+	l.log(LOG_FATAL, s, nil)
 	os.Exit(1)
 }
 func (l *Logger) Fatalf(s string, args ...interface{}) {
-	l.printf(LOG_FATAL, s, args...)
+	l.logf(LOG_FATAL, s, args...)
 	os.Exit(1)
 }
 
 // Internal
-func (l *Logger) print(t int, s string) {
-	if l.IsEnabled && t >= l.Level {
-		l._print(level[t], s)
+func (l *Logger) logf(t int, s string, a ...interface{}) {
+	if l.out.enabled(t) {
+		l.write(t, fmt.Sprintf(s, a...), nil)
 	}
 }
-func (l *Logger) printf(t int, s string, a ...interface{}) {
-	if l.IsEnabled && t >= l.Level {
-		msg := fmt.Sprintf(s, a...)
-		l._print(level[t], msg)
+func (l *Logger) log(t int, msg string, kv []interface{}) {
+	if l.out.enabled(t) {
+		l.write(t, msg, kv)
 	}
 }
 
-func (l *Logger) _print(lvl, msg string) {
+func (l *Logger) write(t int, msg string, kv []interface{}) {
 	_, file, line, _ := runtime.Caller(3)
-	bfile := strings.TrimPrefix(strings.ToLower(file), l.BasePath)
-	l.Log.Printf("| %s | %s:%d | %s", lvl, bfile, line, msg)
+	e := &Entry{
+		Time:   time.Now(),
+		Level:  t,
+		Logger: l.name,
+		Caller: fmt.Sprintf("%s:%d", strings.TrimPrefix(file, basePath), line),
+		Msg:    msg,
+		Fields: append(append([]Field{}, l.fields...), toFields(kv)...),
+	}
+	l.out.write(e)
+}
+
+// basePath is trimmed from caller file names
+var basePath = func() string {
+	p, err := filepath.Abs(".")
+	if err != nil {
+		return ""
+	}
+	return p + "/"
+}()
+
+// toFields converts key/value pairs to fields. Key without value gets
+// "!MISSING" value
+func toFields(kv []interface{}) []Field {
+	fields := []Field{}
+	for i := 0; i < len(kv); i += 2 {
+		f := Field{Key: fmt.Sprint(kv[i]), Value: "!MISSING"}
+		if i + 1 < len(kv) {
+			f.Value = kv[i+1]
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// logFile is file used by DefaultOutput if log path set
+var logFile *RotatingFile
+var logFileLock sync.Mutex
+
+// ConfigureLog sets DefaultOutput by log settings of config. It can be
+// called again on config reload; log file is reopened only if path changed
+func ConfigureLog(c *Config) error {
+	lvl := c.LogLevel
+	if !c.LogEnable {
+		lvl = LOG_OFF
+	}
+	var enc Encoder = TextEncoder{}
+	if c.LogFormat == "json" {
+		enc = JSONEncoder{}
+	}
+	var w io.Writer = os.Stdout
+	if c.LogPath != "" {
+		dir, err := filepath.Abs(c.LogPath)
+		if err != nil {
+			return err
+		}
+		w = openLogFile(dir, int64(c.LogMaxSize) << 20)
+	}
+	defaultOutput.Configure(w, enc, lvl)
+	return nil
+}
+
+func openLogFile(dir string, maxSize int64) *RotatingFile {
+	logFileLock.Lock()
+	defer logFileLock.Unlock()
+	if logFile != nil && logFile.Dir == dir {
+		logFile.setMaxSize(maxSize)
+		return logFile
+	}
+	if logFile != nil {
+		logFile.Close() // Reopened if written before output switched
+	}
+	logFile = NewRotatingFile(dir, "geep-server.log", maxSize)
+	return logFile
 }
@@ -0,0 +1,76 @@
+package lib
+
+import (
+	"os"
+	"bytes"
+	"strings"
+	"testing"
+	"io/ioutil"
+	"encoding/json"
+	"path/filepath"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoggerText(t *testing.T) {
+	var b bytes.Buffer
+	l := NewLoggerOutput("server", NewOutput(&b, TextEncoder{}, LOG_INFO))
+	l.Debugf("skipped %d", 1)
+	l.Named("conn").With("addr", "127.0.0.1:1").Infow("Connected", "db", 2, "msg", "a b")
+
+	line := b.String()
+	assert.Equal(t, 1, strings.Count(line, "\n"))
+	assert.Contains(t, line, "| INFO  | server.conn | ")
+	assert.Contains(t, line, "log_test.go:")
+	assert.True(t, strings.HasSuffix(line, `| Connected addr=127.0.0.1:1 db=2 msg="a b"`+"\n"), line)
+}
+
+func TestLoggerJSON(t *testing.T) {
+	var b bytes.Buffer
+	l := NewLoggerOutput("storage", NewOutput(&b, JSONEncoder{}, LOG_DEBUG))
+	l.Warnw("Key not found", "key", "k1", "err", os.ErrNotExist, "odd")
+
+	m := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(b.Bytes(), &m))
+	assert.Equal(t, "warn", m["level"])
+	assert.Equal(t, "storage", m["logger"])
+	assert.Equal(t, "Key not found", m["msg"])
+	assert.Equal(t, "k1", m["key"])
+	assert.Equal(t, os.ErrNotExist.Error(), m["err"])
+	assert.Equal(t, "!MISSING", m["odd"])
+}
+
+func TestNewLoggerNamed(t *testing.T) {
+	assert.Equal(t, "server", NewLogger("server").Name())
+	assert.Equal(t, "storage", NewLogger("storage").Name())
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gache_log")
+	defer os.RemoveAll(dir)
+	day := time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)
+	r := NewRotatingFile(dir, "test.log", 10)
+	r.now = func() time.Time { return day }
+	defer r.Close()
+
+	// Existing file appended, not truncated
+	ioutil.WriteFile(r.Path("2020-01-02"), []byte("old\n"), 0666)
+	r.Write([]byte("12345\n"))
+	data, _ := ioutil.ReadFile(r.Path("2020-01-02"))
+	assert.Equal(t, "old\n12345\n", string(data))
+
+	// Rotated by size
+	r.Write([]byte("67890\n"))
+	data, _ = ioutil.ReadFile(r.Path("2020-01-02") + ".1")
+	assert.Equal(t, "old\n12345\n", string(data))
+	data, _ = ioutil.ReadFile(r.Path("2020-01-02"))
+	assert.Equal(t, "67890\n", string(data))
+
+	// Rotated by date
+	day = day.Add(24 * time.Hour)
+	r.Write([]byte("next\n"))
+	data, _ = ioutil.ReadFile(r.Path("2020-01-03"))
+	assert.Equal(t, "next\n", string(data))
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	assert.Equal(t, 3, len(files))
+}
@@ -0,0 +1,111 @@
+package lib
+
+import (
+	"os"
+	"fmt"
+	"sync"
+	"time"
+	"path/filepath"
+)
+
+// RotatingFile is log file writer rotating files by date and size. Entries
+// are written to Dir/<date>_<Name>. New file is started every day and when
+// file grows over MaxSize bytes; full file renamed to <date>_<Name>.<N>.
+// Existing files are appended, never truncated.
+type RotatingFile struct {
+	Dir     string
+	Name    string
+	MaxSize int64 // 0 - unlimited
+	lock    sync.Mutex
+	f       *os.File
+	date    string
+	size    int64
+	now     func() time.Time
+}
+
+// NewRotatingFile creates RotatingFile. File opened on first write
+func NewRotatingFile(dir, name string, maxSize int64) *RotatingFile {
+	return &RotatingFile{Dir: dir, Name: name, MaxSize: maxSize, now: time.Now}
+}
+
+// Write implements io.Writer
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	date := r.now().Format("2006-01-02")
+	if r.f == nil || date != r.date {
+		if err := r.open(date); err != nil {
+			return 0, err
+		}
+	}
+	if r.MaxSize > 0 && r.size > 0 && r.size + int64(len(p)) > r.MaxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) setMaxSize(n int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.MaxSize = n
+}
+
+// Close closes current file
+func (r *RotatingFile) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// Path returns path of file for date
+func (r *RotatingFile) Path(date string) string {
+	return filepath.Join(r.Dir, date + "_" + r.Name)
+}
+
+// open closes current file and opens file for date in append mode
+func (r *RotatingFile) open(date string) error {
+	if r.f != nil {
+		r.f.Close()
+		r.f = nil
+	}
+	if err := os.MkdirAll(r.Dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.Path(date), os.O_APPEND | os.O_WRONLY | os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.date, r.size = f, date, fi.Size()
+	return nil
+}
+
+// rotate renames full file to first free <path>.<N> and opens new one
+func (r *RotatingFile) rotate() error {
+	r.f.Close()
+	r.f = nil
+	path := r.Path(r.date)
+	for i := 1; ; i++ {
+		next := fmt.Sprintf("%s.%d", path, i)
+		if _, err := os.Stat(next); os.IsNotExist(err) {
+			if err := os.Rename(path, next); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return r.open(r.date)
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"os"
+	"sync"
+	"bufio"
+	"strings"
+	"strconv"
+	"crypto/rand"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	s "github.com/avsolo/gache/storage"
+)
+
+// Command categories used by ACL. CatAll allows everything, CatConn
+// commands are allowed for any authenticated user
+const (
+	CatAll    = "all"
+	CatRead   = "read"
+	CatWrite  = "write"
+	CatAdmin  = "admin"
+	CatPubSub = "pubsub"
+	CatConn   = "conn"
+)
+
+// DefaultUser is name of user authenticated by AUTH with password only
+const DefaultUser = "default"
+
+// commandCategories maps every command to ACL category
+var commandCategories = map[string]string{
+	CMD_SET: CatWrite, CMD_GET: CatRead, CMD_UPD: CatWrite, CMD_DEL: CatWrite,
+	CMD_LSET: CatWrite, CMD_LPUSH: CatWrite, CMD_LPOP: CatWrite,
+	CMD_DSET: CatWrite, CMD_DGET: CatRead, CMD_DADD: CatWrite, CMD_DDEL: CatWrite,
+	CMD_EXPIRE: CatWrite, CMD_EXPIREAT: CatWrite, CMD_TTL: CatRead, CMD_PERSIST: CatWrite,
+	CMD_KSUBSCRIBE: CatPubSub, CMD_SUBSCRIBE: CatPubSub, CMD_PSUBSCRIBE: CatPubSub,
+	CMD_UNSUBSCRIBE: CatPubSub, CMD_PUNSUBSCRIBE: CatPubSub, CMD_PUBLISH: CatPubSub,
+	CMD_KEYS: CatRead, CMD_SCAN: CatRead, CMD_EXISTS: CatRead, CMD_TYPE: CatRead,
+	CMD_RENAME: CatWrite, CMD_RANDOMKEY: CatRead,
+	CMD_TSET: CatWrite, CMD_INVALIDATE: CatWrite, CMD_DELPREFIX: CatWrite,
+	CMD_MEMORY: CatRead,
+	CMD_SELECT: CatConn, CMD_DBSIZE: CatRead, CMD_MOVE: CatWrite,
+	CMD_PING: CatConn, CMD_AUTH: CatConn,
+	CMD_OPT: CatAdmin, CMD_INFO: CatAdmin, CMD_SLOWLOG: CatAdmin,
+}
+
+// User is ACL user. Hash is password hash made by HashPassword. User can
+// run commands of Categories for keys matched by Keys glob patterns
+type User struct {
+	Name       string
+	Hash       string
+	Categories map[string]bool
+	Keys       []string
+}
+
+// NewUser creates user with password hash, categories and key patterns
+func NewUser(name, hash string, categories, keys []string) *User {
+	u := &User{Name: name, Hash: hash, Categories: map[string]bool{}, Keys: keys}
+	for _, c := range categories {
+		u.Categories[c] = true
+	}
+	return u
+}
+
+// NewDefaultUser creates DefaultUser with password and full access
+func NewDefaultUser(password string) *User {
+	return NewUser(DefaultUser, HashPassword(password), []string{CatAll}, []string{"*"})
+}
+
+// Allowed checks that user can run cmd for keys. Nil user is allowed
+// everything, it's used when authentication disabled
+func (u *User) Allowed(cmd string, keys ...string) error {
+	if u == nil {
+		return nil
+	}
+	cat := commandCategories[cmd]
+	if cat != CatConn && !u.Categories[cat] && !u.Categories[CatAll] {
+		return ErrNoPerm
+	}
+	for _, key := range keys {
+		if !u.keyAllowed(key) {
+			return ErrNoPerm
+		}
+	}
+	return nil
+}
+
+// anyKey is key checked for commands touching whole keyspace, e.g.
+// RANDOMKEY. It's allowed only for users with pattern matching any key
+const anyKey = "*"
+
+// keyAllowed checks key by user patterns. Nil user is allowed any key.
+// Commands matching keys by glob (KEYS, SCAN, DELPREFIX, KSUBSCRIBE)
+// check every matched key, not glob itself, because glob isn't a key and
+// could match keys hidden from user (e.g. "user:*" for "user:?")
+func (u *User) keyAllowed(key string) bool {
+	if u == nil {
+		return true
+	}
+	for _, ptn := range u.Keys {
+		if key == anyKey {
+			if ptn != "" && strings.Trim(ptn, "*") == "" {
+				return true
+			}
+			continue
+		}
+		if ok, _ := s.MatchPattern(ptn, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedKeys returns keys allowed for user keeping their order
+func (u *User) allowedKeys(keys []string) []string {
+	if u == nil {
+		return keys
+	}
+	allowed := []string{}
+	for _, key := range keys {
+		if u.keyAllowed(key) {
+			allowed = append(allowed, key)
+		}
+	}
+	return allowed
+}
+
+// ACL keeps users allowed to connect to server
+type ACL struct {
+	lock  sync.RWMutex
+	users map[string]*User
+}
+
+// NewACL creates empty ACL
+func NewACL() *ACL {
+	return &ACL{users: map[string]*User{}}
+}
+
+
+// LoadACL reads ACL from file. Each line of file describes one user:
+//      name  hash  categories  key_patterns
+// where categories and key patterns are separated by comma, e.g.:
+//      alice  pbkdf2-sha256$600000$9f..$1c..  read,write  user:*,session:*
+// Empty lines and lines started with # are skipped
+func LoadACL(path string) (*ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a := NewACL()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			return nil, ErrBadACL
+		}
+		a.AddUser(NewUser(fields[0], fields[1],
+			strings.Split(fields[2], ","), strings.Split(fields[3], ",")))
+	}
+	return a, sc.Err()
+}
+
+// AddUser adds or replaces user
+func (a *ACL) AddUser(u *User) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.users[u.Name] = u
+}
+
+// Authenticate returns user if password is correct
+func (a *ACL) Authenticate(name, password string) (*User, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	u, found := a.users[name]
+	if !found || !CheckPassword(u.Hash, password) {
+		return nil, ErrAuthFailed
+	}
+	return u, nil
+}
+
+// PasswordIterations is PBKDF2 iteration count used by HashPassword. Hash
+// keeps its count, so changing it doesn't break existing hashes
+var PasswordIterations = 600000
+
+// HashPassword returns salted password hash in
+// "pbkdf2-sha256$iterations$salt$hash" format
+func HashPassword(password string) string {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	return hashPassword(PasswordIterations, hex.EncodeToString(salt), password)
+}
+
+// CheckPassword compares password with hash made by HashPassword
+func CheckPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter < 1 {
+		return false
+	}
+	expected := hashPassword(iter, parts[2], password)
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(hash)) == 1
+}
+
+func hashPassword(iter int, salt, password string) string {
+	key, _ := pbkdf2.Key(sha256.New, password, []byte(salt), iter, sha256.Size) // Only FIPS mode limits arguments
+	return _s("pbkdf2-sha256$%d$%s$%s", iter, salt, hex.EncodeToString(key))
+}
+
+// requestKeys returns keys touched by request. Commands working with
+// whole keyspace return anyKey. Commands matching keys by glob return
+// nil, their routes check every matched key
+func requestKeys(r *Request) []string {
+	switch r.Cmd {
+	case CMD_PUBLISH, CMD_SUBSCRIBE, CMD_PSUBSCRIBE, CMD_PING, CMD_AUTH,
+		CMD_SELECT, CMD_OPT, CMD_INFO, CMD_SLOWLOG,
+		CMD_KEYS, CMD_SCAN, CMD_DELPREFIX, CMD_KSUBSCRIBE:
+		return nil
+	case CMD_RENAME:
+		return []string{r.Key, r.Value}
+	case CMD_EXISTS:
+		return strings.Fields(r.Value)
+	case CMD_RANDOMKEY, CMD_DBSIZE, CMD_INVALIDATE:
+		return []string{anyKey}
+	case CMD_MEMORY:
+		if r.Raw["top"] != "" {
+			return []string{anyKey}
+		}
+	}
+	return []string{r.Key}
+}
@@ -18,25 +18,44 @@ package server
 import (
     "fmt"
     "net"
+    "time"
+    "sync"
     "bufio"
+    "regexp"
+    "crypto/tls"
     "strings"
+    "strconv"
     // "io/ioutil"
+	st "github.com/avsolo/gache/storage"
 )
 
-// Client is wrapper about net.TCPConn and some validation
+// Client is wrapper about TCP or Unix socket connection (for address
+// prefixed with UnixPrefix) and some validation. If KeepAlive
+// set, Client uses one connection for all requests (server must be run
+// with KeepAlive too). If TLSConfig set, connections use TLS. Client isn't
+// safe for concurrent use
 type Client struct {
-	addr *net.TCPAddr
-	Conn *net.TCPConn
+	network string
+	addr string
+	Conn net.Conn
 	KeepAlive bool
+	TLSConfig *tls.Config
+	reader *bufio.Reader
+	db int
+	user string
+	password string
 }
 
 // NewClient return pointer to new created Client
 func NewClient(addr string) *Client {
-	var err error
 	c := &Client{KeepAlive: false}
-	c.addr, err = net.ResolveTCPAddr("tcp", addr)
-	if err != nil {
-		panic("Unable resolve addr. Error: " + err.Error())
+	c.network, c.addr = parseAddr(addr)
+	if c.network == "tcp" {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			panic("Unable resolve addr. Error: " + err.Error())
+		}
+		c.addr = tcpAddr.String()
 	}
 	return c
 }
@@ -52,37 +71,597 @@ func (c *Client) Send(s string) (string, error) {
 	// Create connection
 	var err error
     if ! c.KeepAlive || c.Conn == nil {
-		c.Conn, err = net.DialTCP("tcp", nil, c.addr)
-		if err != nil {
-			log.Warnf("Dial error: %v", err)
+		if err = c.connect(); err != nil {
 			return "", err
 		}
     }
+	return c.roundTrip(s, true)
+}
+
+// connect makes new connection and authenticates it if Auth called. For
+// kept alive connection it restores selected database
+func (c *Client) connect() error {
+	var err error
+	c.Conn, err = c.dial()
+	if err != nil {
+		return err
+	}
+	c.reader = bufio.NewReader(c.Conn)
+	if c.password != "" {
+		res, err := c.roundTrip(c.authCmd(), false)
+		if err == nil {
+			err = replyErr(res)
+		}
+		if err != nil {
+			c.Close()
+			return err
+		}
+	}
+	if c.KeepAlive && c.db != 0 {
+		res, err := c.roundTrip(_s("%s %d", CMD_SELECT, c.db), false)
+		if err == nil {
+			err = replyErr(res)
+		}
+		return err
+	}
+	return nil
+}
 
-	// Write
-	_, err = c.Conn.Write([]byte(s + "\r\n"))
+// roundTrip writes one request to current connection and reads response.
+// Without KeepAlive connection is half-closed after last request
+func (c *Client) roundTrip(s string, last bool) (string, error) {
+	_, err := c.Conn.Write([]byte(s + "\r\n"))
 	if err != nil {
 		log.Debugf("Write error: %s\n", err.Error())
+		c.Close()
 		return "", err
 	}
-    c.Conn.CloseWrite()
+	if cw, ok := c.Conn.(closeWriter); ok && ! c.KeepAlive && last {
+		cw.CloseWrite()
+	}
 
 	// Read response
-    buf, err := bufio.NewReader(c.Conn).ReadString('\n')
+    buf, err := c.reader.ReadString('\n')
 	if err != nil {
 		log.Debugf("Read error: %s\n", err.Error())
+		c.Close()
 		return "", err
 	}
-    c.Conn.CloseRead()
 	return strings.TrimSpace(string(buf)), nil
 }
 
+// Auth sets credentials sent with AUTH on every new connection and checks
+// them. Empty user means DefaultUser
+func (c *Client) Auth(user, password string) error {
+	c.user, c.password = user, password
+	if c.Conn != nil {
+		_, err := c.Call("%s", c.authCmd())
+		return err
+	}
+	_, err := c.Call("%s", CMD_PING) // Connection authenticated by connect
+	return err
+}
+
+func (c *Client) authCmd() string {
+	if c.user == "" {
+		return CMD_AUTH + " " + c.password
+	}
+	return CMD_AUTH + " " + c.user + " " + c.password
+}
+
+// Select switches kept alive connection to database db
+func (c *Client) Select(db int) error {
+	if ! c.KeepAlive {
+		return ErrNoKeepAlive
+	}
+	if _, err := c.Call("%s %d", CMD_SELECT, db); err != nil {
+		return err
+	}
+	c.db = db
+	return nil
+}
+
+// Info returns server stats as map of INFO fields
+func (c *Client) Info() (map[string]string, error) {
+	res, err := c.Call("%s", CMD_INFO)
+	if err != nil {
+		return nil, err
+	}
+	info := map[string]string{}
+	for _, f := range strings.Fields(res) {
+		if kv := strings.SplitN(f, ":", 2); len(kv) == 2 {
+			info[kv[0]] = kv[1]
+		}
+	}
+	return info, nil
+}
+
+// SlowLog returns up to n newest slow log entries, newest first. Non-positive
+// n returns all entries
+func (c *Client) SlowLog(n int) ([]*SlowLogEntry, error) {
+	cmd := CMD_SLOWLOG + " GET"
+	if n > 0 {
+		cmd = _s("%s %d", cmd, n)
+	}
+	res, err := c.Call("%s", cmd)
+	if err != nil {
+		return nil, err
+	}
+	entries := []*SlowLogEntry{}
+	for _, f := range strings.Fields(res) {
+		e, err := parseSlowLogEntry(f)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// SlowLogLen returns number of slow log entries
+func (c *Client) SlowLogLen() (int, error) {
+	res, err := c.Call("%s LEN", CMD_SLOWLOG)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(res)
+}
+
+// SlowLogReset removes all slow log entries
+func (c *Client) SlowLogReset() error {
+	_, err := c.Call("%s RESET", CMD_SLOWLOG)
+	return err
+}
+
+// DBSize returns number of keys in current database
+func (c *Client) DBSize() (int, error) {
+	res, err := c.Call("%s", CMD_DBSIZE)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(res)
+}
+
+// Move moves key from current database to db
+func (c *Client) Move(key string, db int) error {
+	_, err := c.Call("%s %s %d", CMD_MOVE, key, db)
+	return err
+}
+
+// dial makes new connection to server
+func (c *Client) dial() (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if c.TLSConfig != nil {
+		conn, err = tls.Dial(c.network, c.addr, c.TLSConfig)
+	} else {
+		conn, err = net.Dial(c.network, c.addr)
+	}
+	if err != nil {
+		log.Warnf("Dial error: %v", err)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// closeWriter is connection which can be half-closed, like *net.TCPConn,
+// *net.UnixConn and *tls.Conn
+type closeWriter interface {
+	CloseWrite() error
+}
+
 // Sendf is shorctut for Send method with parameters subtituting
 func (c *Client) Sendf(s string, args ...interface{}) (string, error) {
     msg := fmt.Sprintf(s, args...)
     return c.Send(msg)
 }
 
+// Close closes current connection if any
 func (c *Client) Close() {
-	c.Conn.Close()
+	if c.Conn != nil {
+		c.Conn.Close()
+		c.Conn = nil
+	}
+}
+
+// ReplyError is error returned by server in "[code] message" format
+type ReplyError struct {
+	Code int
+	Msg string
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("[%d] %s", e.Code, e.Msg)
+}
+
+// replyPtn matches server status replies like "[204]" or "[400] Bad TTL"
+var replyPtn = regexp.MustCompile(`^\[(\d{3})\]\s*(.*)$`)
+
+// knownErrors used to convert error replies back to storage errors, so
+// client code can compare them as for local Storage
+var knownErrors = map[string]error{}
+
+func init() {
+	for _, e := range []error{st.ErrNotFound, st.ErrAlreadyExists,
+		st.ErrNoExpire, st.ErrBadTTL, st.ErrNotList, st.ErrNotDict,
+		st.ErrBadPattern, st.ErrBadEvent, st.ErrEmpty, st.ErrBadCursor,
+		st.ErrOutOfMemory,
+		ErrBadDB, ErrNoSession, ErrAuthRequired, ErrAuthFailed,
+		ErrAuthNotSet, ErrNoPerm} {
+		knownErrors[e.Error()] = e
+	}
+}
+
+// Call is like Sendf but converts error replies to error
+func (c *Client) Call(s string, args ...interface{}) (string, error) {
+	res, err := c.Sendf(s, args...)
+	if err != nil {
+		return "", err
+	}
+	if err = replyErr(res); err != nil {
+		return "", err
+	}
+	return res, nil
+}
+
+// replyErr returns error if res is error reply or nil otherwise
+func replyErr(res string) error {
+	m := replyPtn.FindStringSubmatch(res)
+	if m == nil {
+		return nil
+	}
+	code, _ := strconv.Atoi(m[1])
+	if code < 400 {
+		return nil
+	}
+	if e, found := knownErrors[m[2]]; found {
+		return e
+	}
+	return &ReplyError{Code: code, Msg: m[2]}
+}
+
+// Expire sets new ttl in seconds for key. Non-positive ttl removes expire
+func (c *Client) Expire(key string, ttl int) error {
+	_, err := c.Call("%s %s %d", CMD_EXPIRE, key, ttl)
+	return err
+}
+
+// ExpireAt sets absolute time when key must expire
+func (c *Client) ExpireAt(key string, t time.Time) error {
+	_, err := c.Call("%s %s %d", CMD_EXPIREAT, key, t.Unix())
+	return err
+}
+
+// TTL returns seconds left till key expire. For key without expire returns
+// storage.NoExpire and storage.ErrNoExpire like Storage.TTL does
+func (c *Client) TTL(key string) (int, error) {
+	res, err := c.Call("%s %s", CMD_TTL, key)
+	if err != nil {
+		return st.NoExpire, err
+	}
+	ttl, err := strconv.Atoi(res)
+	if err != nil {
+		return st.NoExpire, ErrBadTTL
+	}
+	if ttl < 0 {
+		return st.NoExpire, st.ErrNoExpire
+	}
+	return ttl, nil
+}
+
+// Persist removes expire from key
+func (c *Client) Persist(key string) error {
+	_, err := c.Call("%s %s", CMD_PERSIST, key)
+	return err
+}
+
+// Keys returns list of keys matched by glob pattern
+func (c *Client) Keys(pattern string) ([]string, error) {
+	res, err := c.Call("%s %s", CMD_KEYS, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(res), nil
+}
+
+// Scan works like storage.Storage.Scan. Use storage.ScanStart as first
+// cursor
+func (c *Client) Scan(cursor, pattern string, count int) (string, []string, error) {
+	res, err := c.Call("%s %s MATCH %s COUNT %d", CMD_SCAN, cursor, pattern, count)
+	if err != nil {
+		return st.ScanStart, nil, err
+	}
+	f := strings.Fields(res)
+	if len(f) == 0 {
+		return st.ScanStart, nil, ErrBadValue
+	}
+	return f[0], f[1:], nil
+}
+
+// Exists returns number of existing keys from passed
+func (c *Client) Exists(keys ...string) (int, error) {
+	res, err := c.Call("%s %s", CMD_EXISTS, strings.Join(keys, " "))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(res)
+}
+
+// Type returns type of key value. For not existing key returns
+// storage.ErrNotFound
+func (c *Client) Type(key string) (string, error) {
+	res, err := c.Call("%s %s", CMD_TYPE, key)
+	if err != nil {
+		return "", err
+	}
+	if res == "none" {
+		return "", st.ErrNotFound
+	}
+	return res, nil
+}
+
+// Rename moves key to newKey
+func (c *Client) Rename(key, newKey string) error {
+	_, err := c.Call("%s %s %s", CMD_RENAME, key, newKey)
+	return err
+}
+
+// RandomKey returns random existing key
+func (c *Client) RandomKey() (string, error) {
+	return c.Call("%s", CMD_RANDOMKEY)
+}
+
+// SetTagged sets key with tags, see storage.Storage.SetTagged. Tags may
+// consist of letters, digits, '_' and ':'
+func (c *Client) SetTagged(key, value string, ttl int, tags ...string) error {
+	_, err := c.Call("%s %s %s %s %d", CMD_TSET, key, strings.Join(tags, ","), value, ttl)
+	return err
+}
+
+// InvalidateTag deletes keys with tag and returns number of deleted keys
+func (c *Client) InvalidateTag(tag string) (int, error) {
+	res, err := c.Call("%s %s", CMD_INVALIDATE, tag)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(res)
+}
+
+// DeleteByPrefix deletes keys starting with prefix and returns number of
+// deleted keys
+func (c *Client) DeleteByPrefix(prefix string) (int, error) {
+	res, err := c.Call("%s %s", CMD_DELPREFIX, prefix)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(res)
+}
+
+// MemoryUsage returns estimated memory used by key in bytes
+func (c *Client) MemoryUsage(key string) (int64, error) {
+	res, err := c.Call("%s USAGE %s", CMD_MEMORY, key)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(res, 10, 64)
+}
+
+// BiggestKeys returns up to n keys using most memory, biggest first
+func (c *Client) BiggestKeys(n int) ([]st.KeySize, error) {
+	res, err := c.Call("%s TOP %d", CMD_MEMORY, n)
+	if err != nil {
+		return nil, err
+	}
+	keys := []st.KeySize{}
+	for _, pair := range strings.Fields(res) {
+		i := strings.LastIndex(pair, ":")
+		if i < 0 {
+			return nil, ErrBadRequest
+		}
+		size, err := strconv.ParseInt(pair[i+1:], 10, 64)
+		if err != nil {
+			return nil, ErrBadRequest
+		}
+		keys = append(keys, st.KeySize{Key: pair[:i], Size: size})
+	}
+	return keys, nil
+}
+
+// EventStream receives keyspace events from server over separate connection
+type EventStream struct {
+	C <-chan st.Event
+	conn net.Conn
+}
+
+// SubscribeKeys subscribes to events for keys matched by glob pattern.
+// If no events passed, all events are delivered. Stream must be closed
+// with Close
+func (c *Client) SubscribeKeys(pattern string, events ...st.EventType) (*EventStream, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	cmd := CMD_KSUBSCRIBE + " " + pattern
+	for _, e := range events {
+		cmd += " " + string(e)
+	}
+	b, err := c.openStream(conn, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan st.Event, st.SubscriptionBuffer)
+	go func() {
+		defer close(ch)
+		for {
+			line, err := b.ReadString('\n')
+			if err != nil {
+				return
+			}
+			f := strings.Fields(line)
+			if len(f) < 1 || f[0] == "ksubscribe" {
+				continue // Skip confirmations
+			}
+			e := st.Event{Type: st.EventType(f[0])}
+			if len(f) > 1 {
+				e.Key = f[1]
+			}
+			if len(f) > 2 {
+				e.Field = f[2]
+			}
+			ch <- e
+		}
+	}()
+	return &EventStream{C: ch, conn: conn}, nil
+}
+
+// Close closes stream connection. Channel C is closed after that
+func (es *EventStream) Close() {
+	es.conn.Close()
+}
+
+// openStream authenticates connection if Auth called, sends cmd and checks
+// server reply for it. Returns reader for next pushed lines
+func (c *Client) openStream(conn net.Conn, cmd string) (*bufio.Reader, error) {
+	b := bufio.NewReader(conn)
+	cmds := []string{cmd}
+	if c.password != "" {
+		cmds = []string{c.authCmd(), cmd}
+	}
+	for _, cmd := range cmds {
+		if _, err := conn.Write([]byte(cmd + "\r\n")); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		res, err := b.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if err = replyErr(strings.TrimSpace(res)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Message is message received from Pub/Sub channel. Pattern is set if
+// message matched by PSUBSCRIBE pattern
+type Message struct {
+	Channel string
+	Pattern string
+	Payload string
+}
+
+// PubSub is connection in push mode receiving published messages
+type PubSub struct {
+	C <-chan *Message
+	lock sync.Mutex
+	conn net.Conn
+}
+
+// Publish sends msg to channel and returns number of subscribers
+// received it
+func (c *Client) Publish(channel, msg string) (int, error) {
+	res, err := c.Call("%s %s %s", CMD_PUBLISH, channel, msg)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(res)
+}
+
+// Subscribe opens new connection subscribed to channels. PubSub must be
+// closed with Close
+func (c *Client) Subscribe(channels ...string) (*PubSub, error) {
+	return c.openPubSub(CMD_SUBSCRIBE, channels)
+}
+
+// PSubscribe opens new connection subscribed to channels matched by glob
+// patterns. PubSub must be closed with Close
+func (c *Client) PSubscribe(patterns ...string) (*PubSub, error) {
+	return c.openPubSub(CMD_PSUBSCRIBE, patterns)
+}
+
+func (c *Client) openPubSub(cmd string, names []string) (*PubSub, error) {
+	if len(names) == 0 {
+		return nil, ErrBadArgs
+	}
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	b, err := c.openStream(conn, cmd + " " + strings.Join(names, " "))
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *Message, PushBuffer)
+	go func() {
+		defer close(ch)
+		for {
+			line, err := b.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			if m := parseMessage(line); m != nil {
+				ch <- m
+			}
+		}
+	}()
+	return &PubSub{C: ch, conn: conn}, nil
+}
+
+// parseMessage converts pushed line to Message. Returns nil for
+// confirmations and any other lines
+func parseMessage(line string) *Message {
+	switch {
+	case strings.HasPrefix(line, "message "):
+		f := strings.SplitN(line, " ", 3)
+		if len(f) == 3 {
+			return &Message{Channel: f[1], Payload: f[2]}
+		}
+	case strings.HasPrefix(line, "pmessage "):
+		f := strings.SplitN(line, " ", 4)
+		if len(f) == 4 {
+			return &Message{Pattern: f[1], Channel: f[2], Payload: f[3]}
+		}
+	}
+	return nil
+}
+
+// Subscribe adds channels to subscription
+func (ps *PubSub) Subscribe(channels ...string) error {
+	return ps.write(CMD_SUBSCRIBE, channels)
+}
+
+// PSubscribe adds patterns to subscription
+func (ps *PubSub) PSubscribe(patterns ...string) error {
+	return ps.write(CMD_PSUBSCRIBE, patterns)
+}
+
+// Unsubscribe removes channels from subscription. Without arguments
+// removes all channels
+func (ps *PubSub) Unsubscribe(channels ...string) error {
+	return ps.write(CMD_UNSUBSCRIBE, channels)
+}
+
+// PUnsubscribe removes patterns from subscription. Without arguments
+// removes all patterns
+func (ps *PubSub) PUnsubscribe(patterns ...string) error {
+	return ps.write(CMD_PUNSUBSCRIBE, patterns)
+}
+
+func (ps *PubSub) write(cmd string, names []string) error {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	line := strings.TrimSpace(cmd + " " + strings.Join(names, " "))
+	_, err := ps.conn.Write([]byte(line + "\r\n"))
+	return err
+}
+
+// Close closes connection. Channel C is closed after that
+func (ps *PubSub) Close() {
+	ps.conn.Close()
 }
@@ -0,0 +1,73 @@
+package server
+
+import (
+	s "github.com/avsolo/gache/storage"
+)
+
+// databases keeps numbered Storage instances. Each connection works with
+// one of them selected by SELECT command, 0 by default
+type databases struct {
+	list []*s.Storage
+}
+
+func newDatabases(n int, opts ...s.Option) *databases {
+	if n < 1 {
+		n = 1
+	}
+	d := &databases{list: make([]*s.Storage, n)}
+	for i := range d.list {
+		d.list[i] = s.NewStorage(opts...)
+	}
+	return d
+}
+
+// Get returns Storage by number
+func (d *databases) Get(i int) (*s.Storage, error) {
+	if i < 0 || i >= len(d.list) {
+		return nil, ErrBadDB
+	}
+	return d.list[i], nil
+}
+
+// Len returns number of databases
+func (d *databases) Len() int {
+	return len(d.list)
+}
+
+// Databases returns storages served by Server as databases 0, 1 and so on
+func (srv *Server) Databases() []*s.Storage {
+	return append([]*s.Storage{}, srv.databases().list...)
+}
+
+// Close closes all databases
+func (d *databases) Close() {
+	for _, db := range d.list {
+		db.Close()
+	}
+}
+
+// FlushAll flushes all databases
+func (d *databases) FlushAll() {
+	for _, db := range d.list {
+		db.Flush()
+	}
+}
+
+// session keeps state of one client connection
+type session struct {
+	db int
+	acl *ACL // Nil if authentication disabled
+	user *User // Authenticated user
+	srv *Server
+}
+
+// authorize checks that session user can execute request
+func (sess *session) authorize(r *Request) error {
+	if sess.acl == nil || r.Cmd == CMD_AUTH {
+		return nil
+	}
+	if sess.user == nil {
+		return ErrAuthRequired
+	}
+	return sess.user.Allowed(r.Cmd, requestKeys(r)...)
+}
@@ -18,5 +18,57 @@ var ErrBadKey = errors.New("Bad key")
 // ErrBadValue return when value is multiline
 var ErrBadValue = errors.New("Bad value")
 
+// ErrBadDB returns when database number out of range
+var ErrBadDB = errors.New("Bad database")
+
+// ErrNoSession returns when command requires connection state
+var ErrNoSession = errors.New("No session")
+
+// ErrNoKeepAlive returns by client methods which require kept alive
+// connection
+var ErrNoKeepAlive = errors.New("KeepAlive required")
+
 // ErrBadRequest return if request not recognized by patterns listed in routes
 var ErrBadRequest = errors.New("Bad request.")
+
+// ErrPushMode returns when not subscription command sent in push mode
+var ErrPushMode = errors.New("Only (P|K)SUBSCRIBE, (P)UNSUBSCRIBE and PING allowed in push mode")
+
+// ErrServerClosed returns by ListenTCP after Shutdown or Stop called
+var ErrServerClosed = errors.New("Server closed")
+
+// ErrLineTooLong returns when request longer than Server.MaxLineLength
+var ErrLineTooLong = errors.New("Request too long")
+
+// ErrMaxConns returns when server has Server.MaxConns connections already
+var ErrMaxConns = errors.New("Too many connections")
+
+// ErrMaxIPConns returns when client IP has Server.MaxConnsPerIP connections
+var ErrMaxIPConns = errors.New("Too many connections from IP")
+
+// ErrRateLimit returns when client sends commands faster than allowed
+var ErrRateLimit = errors.New("Rate limit exceeded")
+
+// ErrAuthRequired returns when server requires AUTH before other commands
+var ErrAuthRequired = errors.New("Authentication required")
+
+// ErrAuthFailed returns when AUTH got unknown user or wrong password
+var ErrAuthFailed = errors.New("Invalid username or password")
+
+// ErrAuthNotSet returns when AUTH sent but server has no users
+var ErrAuthNotSet = errors.New("Authentication not configured")
+
+// ErrNoPerm returns when user ACL doesn't allow command or key
+var ErrNoPerm = errors.New("Permission denied")
+
+// ErrBadACL returns by LoadACL when ACL file line has wrong format
+var ErrBadACL = errors.New("Bad ACL line")
+
+// ErrBadCert returns when CA file has no PEM encoded certificates
+var ErrBadCert = errors.New("No certificates found")
+
+// ErrSocketInUse returns when Unix socket is listened by another server
+var ErrSocketInUse = errors.New("Socket already in use")
+
+// ErrNotSocket returns when Unix socket path is existing regular file
+var ErrNotSocket = errors.New("Not a socket")
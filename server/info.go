@@ -0,0 +1,121 @@
+package server
+
+import (
+	"sort"
+	"time"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	st "github.com/avsolo/gache/storage"
+)
+
+// Info describes running server, see Server.Info
+type Info struct {
+	Uptime     time.Duration
+	Clients    int              // Open connections
+	Commands   map[string]int64 // Number of processed commands by name
+	Counters   Counters
+	Storage    st.Stats // Sum of stats of all databases
+	DBKeys     []int   // Number of keys in each database
+	MemAlloc   uint64  // Bytes of allocated heap objects
+	MemSys     uint64  // Bytes obtained from OS
+	HeapInuse  uint64  // Bytes in in-use heap spans
+	Goroutines int
+}
+
+// Info returns current server and databases stats
+func (s *Server) Info() Info {
+	info := Info{
+		Commands:   map[string]int64{},
+		Counters:   s.Counters(),
+		Goroutines: runtime.NumGoroutine(),
+	}
+	s.lock.Lock()
+	if !s.started.IsZero() {
+		info.Uptime = time.Since(s.started)
+	}
+	info.Clients = len(s.conns)
+	s.lock.Unlock()
+
+	for cmd, n := range s.commands {
+		if v := atomic.LoadInt64(n); v > 0 {
+			info.Commands[cmd] = v
+		}
+	}
+	for _, db := range s.databases().list {
+		ds := db.Stats()
+		info.DBKeys = append(info.DBKeys, ds.Keys)
+		info.Storage.Keys += ds.Keys
+		info.Storage.Strings += ds.Strings
+		info.Storage.Lists += ds.Lists
+		info.Storage.Dicts += ds.Dicts
+		info.Storage.Expires += ds.Expires
+		info.Storage.Expired += ds.Expired
+		info.Storage.Evicted += ds.Evicted
+		info.Storage.Hits += ds.Hits
+		info.Storage.Misses += ds.Misses
+		info.Storage.Stale += ds.Stale
+		info.Storage.Memory += ds.Memory
+		info.Storage.Compressed += ds.Compressed
+		info.Storage.CompressedSize += ds.CompressedSize
+		info.Storage.OriginalSize += ds.OriginalSize
+	}
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	info.MemAlloc, info.MemSys, info.HeapInuse = m.Alloc, m.Sys, m.HeapInuse
+	return info
+}
+
+// String returns info as space separated "field:value" pairs. Empty
+// databases and not used commands are skipped
+func (i Info) String() string {
+	f := []string{
+		_s("uptime_sec:%d", int64(i.Uptime.Seconds())),
+		_s("clients:%d", i.Clients),
+		_s("goroutines:%d", i.Goroutines),
+		_s("mem_alloc:%d", i.MemAlloc),
+		_s("mem_sys:%d", i.MemSys),
+		_s("mem_heap_inuse:%d", i.HeapInuse),
+		_s("keys:%d", i.Storage.Keys),
+		_s("strings:%d", i.Storage.Strings),
+		_s("lists:%d", i.Storage.Lists),
+		_s("dicts:%d", i.Storage.Dicts),
+		_s("expires:%d", i.Storage.Expires),
+		_s("expired:%d", i.Storage.Expired),
+		_s("evicted:%d", i.Storage.Evicted),
+		_s("hits:%d", i.Storage.Hits),
+		_s("misses:%d", i.Storage.Misses),
+		_s("stale:%d", i.Storage.Stale),
+		_s("used_memory:%d", i.Storage.Memory),
+		_s("compressed:%d", i.Storage.Compressed),
+		_s("compression_ratio:%.2f", i.Storage.CompressionRatio()),
+		_s("rejected_conns:%d", i.Counters.RejectedConns),
+		_s("rejected_ip_conns:%d", i.Counters.RejectedIPConns),
+		_s("rate_limited:%d", i.Counters.RateLimited),
+	}
+	for db, n := range i.DBKeys {
+		if n > 0 {
+			f = append(f, _s("db%d:%d", db, n))
+		}
+	}
+	cmds := []string{}
+	for cmd := range i.Commands {
+		cmds = append(cmds, cmd)
+	}
+	sort.Strings(cmds)
+	for _, cmd := range cmds {
+		f = append(f, _s("cmd_%s:%d", cmd, i.Commands[cmd]))
+	}
+	return strings.Join(f, " ")
+}
+
+// newCommandCounters creates counter for every known command, so counters
+// can be incremented without lock
+func newCommandCounters() map[string]*int64 {
+	c := map[string]*int64{}
+	for cmd := range pathes {
+		c[cmd] = new(int64)
+	}
+	return c
+}
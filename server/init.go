@@ -2,15 +2,61 @@ package server
 
 import (
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"github.com/avsolo/gache/lib"
 	s "github.com/avsolo/gache/storage"
 )
 
-var log *lib.Logger
-var Store *s.Storage
+var log lib.LoggerInterface = lib.NewLogger("server")
+var dbs atomic.Value // *databases, created on first use
+var dbsLock sync.Mutex
+var pubsub *broker
 var _s = fmt.Sprintf
 
+// SetLogger replaces logger of server package. It must be called before
+// any Server created, see also WithLogger
+func SetLogger(l lib.LoggerInterface) {
+	log = l
+}
+
+// DefaultDatabases is number of databases created by default
+const DefaultDatabases = 16
+
+// SetDatabases replaces package databases with n empty ones. It must be
+// called before any Server started
+func SetDatabases(n int) {
+	dbsLock.Lock()
+	defer dbsLock.Unlock()
+	if d, ok := dbs.Load().(*databases); ok {
+		d.Close()
+	}
+	dbs.Store(newDatabases(n))
+}
+
+// Store returns database 0 of package databases, which served by Server
+// created without WithStorage or WithDatabases
+func Store() *s.Storage {
+	return packageDatabases().list[0]
+}
+
+// packageDatabases returns package databases. They are created on first
+// use, so importing package doesn't start expire tracking of unused
+// databases
+func packageDatabases() *databases {
+	if d, ok := dbs.Load().(*databases); ok {
+		return d
+	}
+	dbsLock.Lock()
+	defer dbsLock.Unlock()
+	if d, ok := dbs.Load().(*databases); ok {
+		return d
+	}
+	d := newDatabases(DefaultDatabases)
+	dbs.Store(d)
+	return d
+}
+
 func init() {
-	log = lib.NewLogger("server")
-	Store = s.NewStorage()
+	pubsub = newBroker()
 }
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+	"sync/atomic"
+)
+
+// Rate limit modes
+const (
+	LimitByConn = "conn"
+	LimitByIP   = "ip"
+)
+
+// Counters keeps number of rejected connections and commands
+type Counters struct {
+	RejectedConns   int64 // Over Server.MaxConns
+	RejectedIPConns int64 // Over Server.MaxConnsPerIP
+	RateLimited     int64 // Commands rejected by rate limit
+}
+
+// tokenBucket allows rate commands per second with bursts up to burst
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Allow takes one token if any
+func (b *tokenBucket) Allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full checks that bucket has all tokens, so it's same as new one
+func (b *tokenBucket) full() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill()
+	return b.tokens >= b.burst
+}
+
+// untilFull returns time left till bucket gets all tokens
+func (b *tokenBucket) untilFull() time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill()
+	return time.Duration((b.burst - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// ipState keeps number of connections and rate limit bucket for one IP.
+// Bucket is created by first connection limited by IP
+type ipState struct {
+	conns  int
+	bucket *tokenBucket
+}
+
+// limiter checks connection and command limits of Server
+type limiter struct {
+	lock     sync.Mutex
+	conns    int
+	ips      map[string]*ipState
+	counters Counters
+}
+
+func newLimiter() *limiter {
+	return &limiter{ips: map[string]*ipState{}}
+}
+
+// connect registers new connection. Returns ErrMaxConns or ErrMaxIPConns
+// if limit reached
+func (l *limiter) connect(s *Settings, conn net.Conn) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if s.MaxConns > 0 && l.conns >= s.MaxConns {
+		atomic.AddInt64(&l.counters.RejectedConns, 1)
+		return ErrMaxConns
+	}
+	st := l.ip(remoteIP(conn))
+	if s.MaxConnsPerIP > 0 && st.conns >= s.MaxConnsPerIP {
+		atomic.AddInt64(&l.counters.RejectedIPConns, 1)
+		return ErrMaxIPConns
+	}
+	l.conns++
+	st.conns++
+	return nil
+}
+
+// disconnect unregisters closed connection
+func (l *limiter) disconnect(conn net.Conn) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.conns--
+	ip := remoteIP(conn)
+	if st, found := l.ips[ip]; found {
+		st.conns--
+		l.pruneUnsafe(ip, st)
+	}
+}
+
+// ip returns state of IP creating it if needed
+func (l *limiter) ip(ip string) *ipState {
+	st, found := l.ips[ip]
+	if !found {
+		st = &ipState{}
+		l.ips[ip] = st
+	}
+	return st
+}
+
+// pruneUnsafe drops state of IP without connections. State with not full
+// bucket is kept till bucket refilled, so reconnect doesn't reset rate
+// limit
+func (l *limiter) pruneUnsafe(ip string, st *ipState) {
+	if st.conns > 0 || l.ips[ip] != st {
+		return
+	}
+	if st.bucket == nil || st.bucket.full() {
+		delete(l.ips, ip)
+		return
+	}
+	time.AfterFunc(st.bucket.untilFull(), func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		l.pruneUnsafe(ip, st)
+	})
+}
+
+// bucket returns rate limit bucket for new connection or nil if rate
+// limit disabled
+func (l *limiter) bucket(s *Settings, conn net.Conn) *tokenBucket {
+	if s.RateLimit <= 0 {
+		return nil
+	}
+	if s.RateLimitBy == LimitByIP {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		st := l.ip(remoteIP(conn))
+		if st.bucket == nil {
+			st.bucket = newTokenBucket(s.RateLimit, s.RateBurst)
+		}
+		return st.bucket
+	}
+	return newTokenBucket(s.RateLimit, s.RateBurst)
+}
+
+// allow checks rate limit for one command
+func (l *limiter) allow(b *tokenBucket) bool {
+	if b == nil || b.Allow() {
+		return true
+	}
+	atomic.AddInt64(&l.counters.RateLimited, 1)
+	return false
+}
+
+// Counters returns copy of current counters
+func (l *limiter) Counters() Counters {
+	return Counters{
+		RejectedConns:   atomic.LoadInt64(&l.counters.RejectedConns),
+		RejectedIPConns: atomic.LoadInt64(&l.counters.RejectedIPConns),
+		RateLimited:     atomic.LoadInt64(&l.counters.RateLimited),
+	}
+}
+
+// remoteIP returns IP part of connection remote address
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"io"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"net/http"
+	"sync/atomic"
+)
+
+// LatencyBuckets are upper bounds (in seconds) of command latency
+// histogram buckets
+var LatencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025,
+	0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// histogram counts observed values by buckets like Prometheus histogram
+type histogram struct {
+	lock    sync.Mutex
+	buckets []float64
+	counts  []uint64 // Not cumulative, one per bucket plus +Inf
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets)+1)}
+}
+
+// Observe adds value v to histogram
+func (h *histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// write writes histogram in text exposition format with labels
+func (h *histogram) write(w io.Writer, name, labels string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var n uint64
+	for i, le := range h.buckets {
+		n += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, le, n)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+// metrics keeps Server metrics exposed by MetricsHandler
+type metrics struct {
+	latency  map[string]*histogram // By command, created for all commands
+	lock     sync.Mutex
+	errors   map[int]int64 // By response code
+	accepted int64
+}
+
+func newMetrics() *metrics {
+	m := &metrics{latency: map[string]*histogram{}, errors: map[int]int64{}}
+	for cmd := range pathes {
+		m.latency[cmd] = newHistogram(LatencyBuckets)
+	}
+	return m
+}
+
+// observe adds command latency
+func (m *metrics) observe(cmd string, d time.Duration) {
+	m.latency[cmd].Observe(d.Seconds())
+}
+
+// error counts error response code
+func (m *metrics) error(code int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.errors[code]++
+}
+
+// MetricsHandler returns http.Handler writing server metrics in Prometheus
+// text exposition format
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.writeMetrics(w)
+	})
+}
+
+func (s *Server) writeMetrics(w io.Writer) {
+	m := s.metrics
+	help := func(name, typ, text string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, text, name, typ)
+	}
+
+	help("gache_command_duration_seconds", "histogram", "Command latency by command name.")
+	cmds := []string{}
+	for cmd := range m.latency {
+		cmds = append(cmds, cmd)
+	}
+	sort.Strings(cmds)
+	for _, cmd := range cmds {
+		m.latency[cmd].write(w, "gache_command_duration_seconds", _s("cmd=%q", cmd))
+	}
+
+	help("gache_errors_total", "counter", "Error responses by code.")
+	m.lock.Lock()
+	codes := []int{}
+	for code := range m.errors {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "gache_errors_total{code=\"%d\"} %d\n", code, m.errors[code])
+	}
+	m.lock.Unlock()
+
+	s.lock.Lock()
+	conns := len(s.conns)
+	s.lock.Unlock()
+	help("gache_connections_total", "counter", "Accepted connections.")
+	fmt.Fprintf(w, "gache_connections_total %d\n", atomic.LoadInt64(&m.accepted))
+	help("gache_connections", "gauge", "Open connections.")
+	fmt.Fprintf(w, "gache_connections %d\n", conns)
+
+	help("gache_keys", "gauge", "Number of keys by database.")
+	var expired, evicted, hits, misses int64
+	memory := []int64{}
+	for i, db := range s.databases().list {
+		u := db.Usage()
+		fmt.Fprintf(w, "gache_keys{db=\"%d\"} %d\n", i, u.Keys)
+		memory = append(memory, u.Memory)
+		expired += u.Expired
+		evicted += u.Evicted
+		hits += u.Hits
+		misses += u.Misses
+	}
+	help("gache_expired_keys_total", "counter", "Keys deleted by expire.")
+	fmt.Fprintf(w, "gache_expired_keys_total %d\n", expired)
+	help("gache_evicted_keys_total", "counter", "Keys deleted to free memory.")
+	fmt.Fprintf(w, "gache_evicted_keys_total %d\n", evicted)
+	help("gache_keyspace_hits_total", "counter", "Reads of existing keys.")
+	fmt.Fprintf(w, "gache_keyspace_hits_total %d\n", hits)
+	help("gache_keyspace_misses_total", "counter", "Reads of missing keys.")
+	fmt.Fprintf(w, "gache_keyspace_misses_total %d\n", misses)
+	help("gache_memory_bytes", "gauge", "Estimated memory used by keys by database.")
+	for i, n := range memory {
+		fmt.Fprintf(w, "gache_memory_bytes{db=\"%d\"} %d\n", i, n)
+	}
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"crypto/tls"
+	"github.com/avsolo/gache/lib"
+	s "github.com/avsolo/gache/storage"
+)
+
+// Option configures Server created by NewServer
+type Option func(*Server)
+
+// WithStorage makes Server serve passed storages as databases 0, 1 and so
+// on instead of package databases (see Store and SetDatabases). Storages
+// aren't closed by Server
+func WithStorage(list ...*s.Storage) Option {
+	return func(srv *Server) {
+		if len(list) > 0 {
+			srv.dbs = &databases{list: list}
+			srv.ownDBs = false
+		}
+	}
+}
+
+// WithDatabases makes Server serve n own databases created with storage
+// options. They are closed by Shutdown
+func WithDatabases(n int, opts ...s.Option) Option {
+	return func(srv *Server) {
+		srv.dbs = newDatabases(n, opts...)
+		srv.ownDBs = true
+	}
+}
+
+// WithKeepAlive keeps client connections open between requests
+func WithKeepAlive(on bool) Option {
+	return func(srv *Server) {
+		srv.KeepAlive = on
+	}
+}
+
+// WithSettings sets timeouts, limits, slow log and ACL
+func WithSettings(st Settings) Option {
+	return func(srv *Server) {
+		srv.IdleTimeout = st.IdleTimeout
+		srv.ReadTimeout = st.ReadTimeout
+		srv.WriteTimeout = st.WriteTimeout
+		srv.MaxLineLength = st.MaxLineLength
+		srv.MaxConns = st.MaxConns
+		srv.MaxConnsPerIP = st.MaxConnsPerIP
+		srv.RateLimit = st.RateLimit
+		srv.RateBurst = st.RateBurst
+		srv.RateLimitBy = st.RateLimitBy
+		srv.SlowLogThreshold = st.SlowLogThreshold
+		srv.SlowLogMax = st.SlowLogMax
+		srv.ACL = st.ACL
+	}
+}
+
+// WithACL enables authentication, see Server.ACL
+func WithACL(acl *ACL) Option {
+	return func(srv *Server) {
+		srv.ACL = acl
+	}
+}
+
+// WithTLSConfig enables TLS, see Server.TLSConfig
+func WithTLSConfig(c *tls.Config) Option {
+	return func(srv *Server) {
+		srv.TLSConfig = c
+	}
+}
+
+// WithLogger sets logger of Server instead of package one (see SetLogger)
+func WithLogger(l lib.LoggerInterface) Option {
+	return func(srv *Server) {
+		srv.log = l
+	}
+}
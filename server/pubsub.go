@@ -0,0 +1,273 @@
+package server
+
+import (
+	"sync"
+	"strings"
+	"sync/atomic"
+	s "github.com/avsolo/gache/storage"
+)
+
+// PushBuffer is max number of lines queued for one connection in push
+// mode. Subscriber which doesn't read fast enough is disconnected
+var PushBuffer = 1024
+
+// broker keeps channel subscriptions and delivers published messages
+type broker struct {
+	lock sync.RWMutex
+	channels map[string]map[*subscriber]struct{}
+	patterns map[string]map[*subscriber]struct{}
+	slow int64
+}
+
+func newBroker() *broker {
+	return &broker{
+		channels: map[string]map[*subscriber]struct{}{},
+		patterns: map[string]map[*subscriber]struct{}{},
+	}
+}
+
+// Publish sends msg to all subscribers of channel and returns number of
+// subscribers received it
+func (b *broker) Publish(channel, msg string) int {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	n := 0
+	for sub := range b.channels[channel] {
+		if sub.send("message " + channel + " " + msg) {
+			n++
+		}
+	}
+	for ptn, subs := range b.patterns {
+		if ok, _ := s.MatchPattern(ptn, channel); !ok {
+			continue
+		}
+		for sub := range subs {
+			if sub.send("pmessage " + ptn + " " + channel + " " + msg) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// SlowSubscribers returns number of subscribers disconnected because
+// of full buffer
+func (b *broker) SlowSubscribers() int {
+	return int(atomic.LoadInt64(&b.slow))
+}
+
+func (b *broker) add(set map[string]map[*subscriber]struct{}, name string, sub *subscriber) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, found := set[name]; !found {
+		set[name] = map[*subscriber]struct{}{}
+	}
+	set[name][sub] = struct{}{}
+}
+
+func (b *broker) remove(set map[string]map[*subscriber]struct{}, name string, sub *subscriber) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(set[name], sub)
+	if len(set[name]) == 0 {
+		delete(set, name)
+	}
+}
+
+// subscriber is connection in push mode. It keeps channels, patterns
+// and keyspace subscriptions and queues lines for writing
+type subscriber struct {
+	lock sync.Mutex
+	broker *broker
+	out chan string
+	done chan struct{}
+	once sync.Once
+	channels map[string]struct{}
+	patterns map[string]struct{}
+	keys []*s.Subscription
+	db *s.Storage
+	user *User // Checked by handle and for keyspace events, nil if authentication disabled
+}
+
+// newSubscriber creates subscriber for database db used by KSUBSCRIBE
+func newSubscriber(b *broker, db *s.Storage) *subscriber {
+	return &subscriber{
+		broker: b,
+		db: db,
+		out: make(chan string, PushBuffer),
+		done: make(chan struct{}),
+		channels: map[string]struct{}{},
+		patterns: map[string]struct{}{},
+	}
+}
+
+// send queues line for client. If queue is full subscriber stopped
+func (sub *subscriber) send(line string) bool {
+	if sub.stopped() {
+		return false
+	}
+	select {
+	case sub.out <- line:
+		return true
+	default:
+		log.Warnf("Subscriber too slow, disconnecting")
+		atomic.AddInt64(&sub.broker.slow, 1)
+		go sub.stop() // stop takes broker lock, so don't wait it here
+		return false
+	}
+}
+
+// stop removes all subscriptions and marks subscriber done
+func (sub *subscriber) stop() {
+	sub.once.Do(func() {
+		close(sub.done)
+		sub.lock.Lock()
+		defer sub.lock.Unlock()
+		for ch := range sub.channels {
+			sub.broker.remove(sub.broker.channels, ch, sub)
+		}
+		for ptn := range sub.patterns {
+			sub.broker.remove(sub.broker.patterns, ptn, sub)
+		}
+		for _, ks := range sub.keys {
+			ks.Close()
+		}
+	})
+}
+
+// stopped checks that subscriber already stopped
+func (sub *subscriber) stopped() bool {
+	select {
+	case <-sub.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (sub *subscriber) count() int {
+	return len(sub.channels) + len(sub.patterns) + len(sub.keys)
+}
+
+// subscribe adds channels (or patterns if pattern is true) and queues
+// confirmation for each of them
+func (sub *subscriber) subscribe(names []string, pattern bool) error {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	if sub.stopped() {
+		return nil
+	}
+	set, kind, bset := sub.channels, "subscribe", sub.broker.channels
+	if pattern {
+		set, kind, bset = sub.patterns, "psubscribe", sub.broker.patterns
+		for _, name := range names {
+			if _, err := s.MatchPattern(name, ""); err != nil {
+				return err
+			}
+		}
+	}
+	for _, name := range names {
+		set[name] = struct{}{}
+		sub.broker.add(bset, name, sub)
+		sub.send(_s("%s %s %d", kind, name, sub.count()))
+	}
+	return nil
+}
+
+// unsubscribe removes channels (or patterns). Empty names removes all
+func (sub *subscriber) unsubscribe(names []string, pattern bool) {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	set, kind, bset := sub.channels, "unsubscribe", sub.broker.channels
+	if pattern {
+		set, kind, bset = sub.patterns, "punsubscribe", sub.broker.patterns
+	}
+	if len(names) == 0 {
+		for name := range set {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		delete(set, name)
+		sub.broker.remove(bset, name, sub)
+		sub.send(_s("%s %s %d", kind, name, sub.count()))
+	}
+}
+
+// subscribeKeys forwards keyspace events of storage to subscriber and
+// queues confirmation. Events of keys not allowed for subscriber user
+// are skipped
+func (sub *subscriber) subscribeKeys(st *s.Storage, pattern string, events []s.EventType) error {
+	ks, err := st.Subscribe(pattern, events...)
+	if err != nil {
+		return err
+	}
+	sub.lock.Lock()
+	if sub.stopped() {
+		sub.lock.Unlock()
+		ks.Close()
+		return nil
+	}
+	sub.keys = append(sub.keys, ks)
+	sub.send(_s("ksubscribe %s %d", pattern, sub.count()))
+	sub.lock.Unlock()
+	go func() {
+		for e := range ks.C {
+			if e.Key != "" && !sub.user.keyAllowed(e.Key) {
+				continue // Flush has no key and is sent to all
+			}
+			if !sub.send(e.String()) {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// handle executes command received in push mode. Only subscription
+// commands allowed there
+func (sub *subscriber) handle(line string) {
+	f := strings.Fields(line)
+	if len(f) == 0 {
+		return
+	}
+	// KSUBSCRIBE pattern isn't checked, events are filtered by key
+	if err := sub.user.Allowed(f[0]); err != nil {
+		if _, found := commandCategories[f[0]]; found {
+			sub.send(_s("[403] %s", err.Error()))
+			return
+		}
+	}
+	var err error
+	switch f[0] {
+	case CMD_SUBSCRIBE:
+		err = sub.subscribe(f[1:], false)
+	case CMD_PSUBSCRIBE:
+		err = sub.subscribe(f[1:], true)
+	case CMD_UNSUBSCRIBE:
+		sub.unsubscribe(f[1:], false)
+	case CMD_PUNSUBSCRIBE:
+		sub.unsubscribe(f[1:], true)
+	case CMD_KSUBSCRIBE:
+		if len(f) < 2 {
+			err = ErrBadArgs
+			break
+		}
+		err = sub.subscribeKeys(sub.db, f[1], toEvents(f[2:]))
+	case CMD_PING:
+		sub.send("PONG")
+	default:
+		err = ErrPushMode
+	}
+	if err != nil {
+		sub.send(_s("[400] %s", err.Error()))
+	}
+}
+
+func toEvents(names []string) []s.EventType {
+	events := []s.EventType{}
+	for _, e := range names {
+		events = append(events, s.EventType(e))
+	}
+	return events
+}
@@ -6,6 +6,7 @@ import (
     "regexp"
 	"strings"
 	"strconv"
+	s "github.com/avsolo/gache/storage"
 )
 
 // All our commands available by TCP must be listed in this list
@@ -25,6 +26,40 @@ const (
 	CMD_DADD  = "DADD"
 	CMD_DDEL  = "DDEL"
 
+	CMD_EXPIRE   = "EXPIRE"
+	CMD_EXPIREAT = "EXPIREAT"
+	CMD_TTL      = "TTL"
+	CMD_PERSIST  = "PERSIST"
+
+	CMD_KSUBSCRIBE   = "KSUBSCRIBE"
+	CMD_SUBSCRIBE    = "SUBSCRIBE"
+	CMD_PSUBSCRIBE   = "PSUBSCRIBE"
+	CMD_UNSUBSCRIBE  = "UNSUBSCRIBE"  // Push mode only
+	CMD_PUNSUBSCRIBE = "PUNSUBSCRIBE" // Push mode only
+	CMD_PUBLISH      = "PUBLISH"
+
+	CMD_KEYS      = "KEYS"
+	CMD_SCAN      = "SCAN"
+	CMD_EXISTS    = "EXISTS"
+	CMD_TYPE      = "TYPE"
+	CMD_RENAME    = "RENAME"
+	CMD_RANDOMKEY = "RANDOMKEY"
+
+	CMD_TSET       = "TSET"
+	CMD_INVALIDATE = "INVALIDATE"
+	CMD_DELPREFIX  = "DELPREFIX"
+
+	CMD_MEMORY = "MEMORY"
+
+	CMD_SELECT = "SELECT"
+	CMD_DBSIZE = "DBSIZE"
+	CMD_MOVE   = "MOVE"
+
+	CMD_PING = "PING"
+	CMD_AUTH = "AUTH"
+	CMD_INFO = "INFO"
+	CMD_SLOWLOG = "SLOWLOG"
+
 	CMD_OPT  = "OPT"
 )
 
@@ -39,6 +74,19 @@ var rmc = regexp.MustCompile // Just shorcut
 var setPtn = rmc(`^(?P<key>\w+)\s+(?P<value>.*)\s+(?P<ttl>\d+)$`)
 var dAddPtn = rmc(`^(?P<key>\w+)\s+(?P<value>.*)$`)
 var getPtn = rmc(`^(?P<key>\w+)$`)
+var subPtn = rmc(`^(?P<key>\S+)\s*(?P<value>[\w\s]*)$`)
+var namesPtn = rmc(`^(?P<value>\S+(\s+\S+)*)$`)
+var pubPtn = rmc(`^(?P<key>\S+)\s+(?P<value>.*)$`)
+var emptyPtn = rmc(`^$`)
+var keysPtn = rmc(`^(?P<value>\S+)$`)
+var renamePtn = rmc(`^(?P<key>\w+)\s+(?P<value>\w+)$`)
+var scanPtn = rmc(`^(?P<cursor>\w+)(\s+MATCH\s+(?P<match>\S+))?(\s+COUNT\s+(?P<count>\d+))?$`)
+var ttlPtn = rmc(`^(?P<key>\w+)\s+(?P<ttl>-?\d+)$`)
+var slowLogPtn = rmc(`^(?P<value>GET|LEN|RESET)(\s+(?P<count>\d+))?$`)
+var authPtn = rmc(`^((?P<key>\S+)\s+)?(?P<value>\S+)$`)
+var tagSetPtn = rmc(`^(?P<key>\w+)\s+(?P<tags>[\w:]+(,[\w:]+)*)\s+(?P<value>.*)\s+(?P<ttl>\d+)$`)
+var memoryPtn = rmc(`^((?P<usage>USAGE)\s+(?P<key>\w+)|(?P<top>TOP)(\s+(?P<count>\d+))?)$`)
+var tagPtn = rmc(`^(?P<value>[\w:]+)$`)
 
 // List of routes
 var pathes = map[string]*path{
@@ -55,6 +103,37 @@ var pathes = map[string]*path{
     CMD_DGET: &path{dAddPtn, routeDGet},
     CMD_DADD: &path{dAddPtn, routeDAdd},
 
+    CMD_EXPIRE: &path{ttlPtn, routeExpire},
+    CMD_EXPIREAT: &path{ttlPtn, routeExpireAt},
+    CMD_TTL: &path{getPtn, routeTTL},
+    CMD_PERSIST: &path{getPtn, routePersist},
+
+    CMD_KSUBSCRIBE: &path{subPtn, routeKSubscribe},
+    CMD_SUBSCRIBE: &path{namesPtn, routeSubscribe},
+    CMD_PSUBSCRIBE: &path{namesPtn, routePSubscribe},
+    CMD_PUBLISH: &path{pubPtn, routePublish},
+
+    CMD_KEYS: &path{keysPtn, routeKeys},
+    CMD_SCAN: &path{scanPtn, routeScan},
+    CMD_EXISTS: &path{namesPtn, routeExists},
+    CMD_TYPE: &path{getPtn, routeType},
+    CMD_RENAME: &path{renamePtn, routeRename},
+    CMD_RANDOMKEY: &path{emptyPtn, routeRandomKey},
+
+    CMD_TSET: &path{tagSetPtn, routeTagSet},
+    CMD_INVALIDATE: &path{tagPtn, routeInvalidate},
+    CMD_DELPREFIX: &path{tagPtn, routeDelPrefix},
+    CMD_MEMORY: &path{memoryPtn, routeMemory},
+
+    CMD_SELECT: &path{getPtn, routeSelect},
+    CMD_DBSIZE: &path{emptyPtn, routeDBSize},
+    CMD_MOVE: &path{renamePtn, routeMove},
+
+    CMD_PING: &path{emptyPtn, routePing},
+    CMD_AUTH: &path{authPtn, routeAuth},
+    CMD_INFO: &path{emptyPtn, routeInfo},
+    CMD_SLOWLOG: &path{slowLogPtn, routeSlowLog},
+
     CMD_OPT: &path{getPtn, routeService},
 }
 
@@ -66,6 +145,7 @@ type Request struct {
 	TTL int
 	Method func(r *Request) *Response
     Raw map[string]string
+	session *session
 }
 
 // NewRequest get sting, split and do base validation (number of params,
@@ -73,13 +153,12 @@ type Request struct {
 func NewRequest(in string) (*Request, error) {
 	in = strings.TrimSpace(in)
 	if in == "" {
-		log.Warn("Empty request")
+		log.Warnf("Empty request")
 		return nil, ErrBadRequest
 	}
 	fp := strings.SplitN(in, " ", 2) // First, get CMD name
-	if len(fp) != 2 {
-		log.Warnf("Request creating error: Request: %s", in)
-		return nil, ErrBadRequest
+	if len(fp) == 1 {
+		fp = append(fp, "") // Command without arguments
 	}
 
 	// Create init params
@@ -94,7 +173,7 @@ func NewRequest(in string) (*Request, error) {
 	args := pathes[r.Cmd].Re.FindStringSubmatch(fp[1])
 	if args == nil {
         emsg := _s("Error matching args from string: %#v", fp[1])
-        log.Warnf(emsg)
+        log.Warnw("Bad arguments", "cmd", r.Cmd, "args", fp[1])
 		return nil, errors.New(emsg)
 	}
 
@@ -113,7 +192,7 @@ func NewRequest(in string) (*Request, error) {
 		case "":
 			continue
 		default:
-			return nil, errors.New(_s("Unknown key '%s'", n1[i]))
+			r.Raw[n1[i]] = n // Command specific params
 		}
 	}
 	r.Method = pathes[r.Cmd].Method
@@ -123,3 +202,43 @@ func NewRequest(in string) (*Request, error) {
 func (r *Request) Route() *Response {
 	return r.Method(r)
 }
+
+// db returns Storage selected by request connection
+func (r *Request) db() *s.Storage {
+	if r.session == nil {
+		return Store()
+	}
+	return r.databases().list[r.session.db]
+}
+
+// databases returns databases of server serving request
+func (r *Request) databases() *databases {
+	if r.session == nil || r.session.srv == nil {
+		return packageDatabases()
+	}
+	return r.session.srv.databases()
+}
+
+// broker returns pub/sub broker of server serving request
+func (r *Request) broker() *broker {
+	if r.session == nil || r.session.srv == nil {
+		return pubsub
+	}
+	return r.session.srv.pubsub
+}
+
+// user returns user authenticated by request connection. It's nil if
+// authentication disabled
+func (r *Request) user() *User {
+	if r.session == nil || r.session.acl == nil {
+		return nil
+	}
+	return r.session.user
+}
+
+// subscriber creates push mode subscriber for request connection
+func (r *Request) subscriber() *subscriber {
+	sub := newSubscriber(r.broker(), r.db())
+	sub.user = r.user()
+	return sub
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"fmt"
     "strings"
+	"strconv"
 	s "github.com/avsolo/gache/storage"
 )
 
@@ -11,6 +12,8 @@ type Response struct {
 	Code int
 	Error error
 	Body string
+	// push switches connection to push mode, see Server.push
+	push *subscriber
 }
 
 // NewResponse create Response object frow s body and e error and returns
@@ -22,7 +25,7 @@ func NewResponse(s string, e error) *Response {
 // Below list of routes
 
 func routeSet(r *Request) *Response {
-	err := Store.Set(r.Key, r.Value, r.TTL)
+	err := r.db().Set(r.Key, r.Value, r.TTL)
 	if err != nil {
 		return NewResponse("", err)
 	}
@@ -30,32 +33,121 @@ func routeSet(r *Request) *Response {
 }
 
 func routeGet(r *Request) *Response {
-	val, err := Store.Get(r.Key)
+	val, err := r.db().Get(r.Key)
 	if err != nil { return NewResponse("", s.ErrNotFound) }
 	return NewResponse(fmt.Sprintf("%s", val), nil)
 }
 
 func routeUpdate(r *Request) *Response {
-	err := Store.Update(r.Key, r.Value, r.TTL)
+	err := r.db().Update(r.Key, r.Value, r.TTL)
 	if err != nil { return NewResponse("", err) }
 	return NewResponse("[204]", nil)
 }
 
 func routeDelete(r *Request) *Response {
-	Store.Delete(r.Key)
+	r.db().Delete(r.Key)
 	return NewResponse("[204]", nil)
 }
 
 func routeService(r *Request) *Response {
     switch r.Key {
     case "flush":
-        Store.Flush()
+        r.db().Flush()
+        return NewResponse("[204]", nil)
+    case "flushall":
+        r.databases().FlushAll()
         return NewResponse("[204]", nil)
     default:
         return NewResponse("", ErrBadValue)
     }
 }
 
+func routePing(r *Request) *Response {
+	return NewResponse("PONG", nil)
+}
+
+// routeAuth authenticates connection as user. Only password means
+// DefaultUser
+func routeAuth(r *Request) *Response {
+	if r.session == nil || r.session.acl == nil {
+		return NewResponse("", ErrAuthNotSet)
+	}
+	name := r.Key
+	if name == "" {
+		name = DefaultUser
+	}
+	u, err := r.session.acl.Authenticate(name, r.Value)
+	if err != nil { return NewResponse("", err) }
+	r.session.user = u
+	return NewResponse("[204]", nil)
+}
+
+// routeInfo returns server stats
+func routeInfo(r *Request) *Response {
+	if r.session == nil || r.session.srv == nil {
+		return NewResponse("", ErrNoSession)
+	}
+	return NewResponse(r.session.srv.Info().String(), nil)
+}
+
+// routeSlowLog returns newest slow log entries (all or count), number of
+// entries or resets slow log
+func routeSlowLog(r *Request) *Response {
+	if r.session == nil || r.session.srv == nil {
+		return NewResponse("", ErrNoSession)
+	}
+	l := r.session.srv.slowlog
+	switch r.Value {
+	case "LEN":
+		return NewResponse(fmt.Sprintf("%d", l.Len()), nil)
+	case "RESET":
+		l.Reset()
+		return NewResponse("[204]", nil)
+	}
+	n, _ := strconv.Atoi(r.Raw["count"])
+	entries := []string{}
+	for _, e := range l.Get(n) {
+		entries = append(entries, e.String())
+	}
+	return NewResponse(strings.Join(entries, " "), nil)
+}
+
+// Pub/Sub routes
+
+// routeKSubscribe streams keyspace events for keys matched by pattern
+func routeKSubscribe(r *Request) *Response {
+	sub := r.subscriber()
+	err := sub.subscribeKeys(r.db(), r.Key, toEvents(strings.Fields(r.Value)))
+	if err != nil { return NewResponse("", err) }
+	resp := NewResponse("[200]", nil)
+	resp.push = sub
+	return resp
+}
+
+func routeSubscribe(r *Request) *Response {
+	sub := r.subscriber()
+	sub.subscribe(strings.Fields(r.Value), false)
+	resp := NewResponse("[200]", nil)
+	resp.push = sub
+	return resp
+}
+
+func routePSubscribe(r *Request) *Response {
+	sub := r.subscriber()
+	if err := sub.subscribe(strings.Fields(r.Value), true); err != nil {
+		return NewResponse("", err)
+	}
+	resp := NewResponse("[200]", nil)
+	resp.push = sub
+	return resp
+}
+
+// routePublish returns number of subscribers received message
+func routePublish(r *Request) *Response {
+	n := r.broker().Publish(r.Key, r.Value)
+	return NewResponse(fmt.Sprintf("%d", n), nil)
+}
+
 // List routes
 func routeLSet(r *Request) *Response {
     vals := strings.Split(r.Value, " ")
@@ -64,7 +156,7 @@ func routeLSet(r *Request) *Response {
         rVal = append(rVal, v)
     }
     rVal = append(rVal, r.TTL)
-	err := Store.LSet(r.Key, rVal...)
+	err := r.db().LSet(r.Key, rVal...)
 	if err != nil {
 		return NewResponse("", err)
 	}
@@ -72,13 +164,13 @@ func routeLSet(r *Request) *Response {
 }
 
 func routeLPush(r *Request) *Response {
-	err := Store.LPush(r.Key, r.Value)
+	err := r.db().LPush(r.Key, r.Value)
 	if err != nil { return NewResponse("", s.ErrNotFound) }
 	return NewResponse("[204]", nil)
 }
 
 func routeLPop(r *Request) *Response {
-	val, err := Store.LPop(r.Key)
+	val, err := r.db().LPop(r.Key)
 	if err != nil { return NewResponse("", s.ErrNotFound) }
 	return NewResponse(fmt.Sprintf("%s", val), nil)
 }
@@ -93,7 +185,7 @@ func routeDSet(r *Request) *Response {
     }
     rVal = append(rVal, r.TTL)
 
-	err := Store.DSet(r.Key, rVal...)
+	err := r.db().DSet(r.Key, rVal...)
 	if err != nil {
 		return NewResponse("[400]", err)
 	}
@@ -101,14 +193,163 @@ func routeDSet(r *Request) *Response {
 }
 
 func routeDGet(r *Request) *Response {
-	val, err := Store.DGet(r.Key, r.Value)
+	val, err := r.db().DGet(r.Key, r.Value)
 	if err != nil { return NewResponse("[404]", s.ErrNotFound) }
 	return NewResponse(fmt.Sprintf("%s", val), nil)
 }
 
 func routeDAdd(r *Request) *Response {
     v := strings.Split(r.Value, " ")
-	err := Store.DAdd(r.Key, strings.TrimSpace(v[0]), strings.TrimSpace(v[1]))
+	err := r.db().DAdd(r.Key, strings.TrimSpace(v[0]), strings.TrimSpace(v[1]))
 	if err != nil { return NewResponse("", s.ErrNotFound) }
 	return NewResponse("[204]", nil)
 }
+
+// TTL routes
+func routeExpire(r *Request) *Response {
+	err := r.db().SetTTL(r.Key, r.TTL)
+	if err != nil { return NewResponse("", err) }
+	return NewResponse("[204]", nil)
+}
+
+// routeExpireAt uses TTL field as absolute unix timestamp
+func routeExpireAt(r *Request) *Response {
+	err := r.db().ExpireAt(r.Key, r.TTL)
+	if err != nil { return NewResponse("", err) }
+	return NewResponse("[204]", nil)
+}
+
+// routeTTL returns seconds left till expire or -1 if key never expires
+func routeTTL(r *Request) *Response {
+	ttl, err := r.db().TTL(r.Key)
+	if err != nil && err != s.ErrNoExpire { return NewResponse("", err) }
+	return NewResponse(fmt.Sprintf("%d", ttl), nil)
+}
+
+func routePersist(r *Request) *Response {
+	err := r.db().Persist(r.Key)
+	if err != nil { return NewResponse("", err) }
+	return NewResponse("[204]", nil)
+}
+
+// Keys routes
+
+// routeKeys returns space separated list of keys allowed for user
+func routeKeys(r *Request) *Response {
+	keys, err := r.db().Keys(r.Value)
+	if err != nil { return NewResponse("", err) }
+	return NewResponse(strings.Join(r.user().allowedKeys(keys), " "), nil)
+}
+
+// routeScan returns next cursor and found keys allowed for user
+// separated by space
+func routeScan(r *Request) *Response {
+	match := r.Raw["match"]
+	if match == "" {
+		match = "*"
+	}
+	count, _ := strconv.Atoi(r.Raw["count"])
+	next, keys, err := r.db().Scan(r.Raw["cursor"], match, count)
+	if err != nil { return NewResponse("", err) }
+	keys = r.user().allowedKeys(keys)
+	return NewResponse(strings.Join(append([]string{next}, keys...), " "), nil)
+}
+
+func routeExists(r *Request) *Response {
+	n := r.db().Exists(strings.Fields(r.Value)...)
+	return NewResponse(fmt.Sprintf("%d", n), nil)
+}
+
+// routeType returns "none" for not existing key
+func routeType(r *Request) *Response {
+	t, err := r.db().Type(r.Key)
+	if err == s.ErrNotFound { return NewResponse("none", nil) }
+	if err != nil { return NewResponse("", err) }
+	return NewResponse(t, nil)
+}
+
+func routeRename(r *Request) *Response {
+	err := r.db().Rename(r.Key, r.Value)
+	if err != nil { return NewResponse("", err) }
+	return NewResponse("[204]", nil)
+}
+
+func routeRandomKey(r *Request) *Response {
+	key, err := r.db().RandomKey()
+	if err != nil { return NewResponse("", err) }
+	return NewResponse(key, nil)
+}
+
+// Tag routes
+
+// routeTagSet sets key with comma separated tags
+func routeTagSet(r *Request) *Response {
+	tags := strings.Split(r.Raw["tags"], ",")
+	err := r.db().SetTagged(r.Key, r.Value, r.TTL, tags...)
+	if err != nil { return NewResponse("", err) }
+	return NewResponse("[201]", nil)
+}
+
+// routeInvalidate returns number of keys deleted by tag
+func routeInvalidate(r *Request) *Response {
+	n, err := r.db().InvalidateTag(r.Value)
+	if err != nil { return NewResponse("", err) }
+	return NewResponse(fmt.Sprintf("%d", n), nil)
+}
+
+// routeDelPrefix returns number of keys deleted by prefix. Only keys
+// allowed for user are deleted
+func routeDelPrefix(r *Request) *Response {
+	n, err := r.db().DeleteByPrefixFunc(r.Value, r.user().keyAllowed)
+	if err != nil { return NewResponse("", err) }
+	return NewResponse(fmt.Sprintf("%d", n), nil)
+}
+
+// DefaultMemoryTop is number of keys returned by MEMORY TOP without count
+const DefaultMemoryTop = 10
+
+// routeMemory returns estimated memory used by key (MEMORY USAGE key) or
+// biggest keys as space separated "key:size" pairs (MEMORY TOP [count])
+func routeMemory(r *Request) *Response {
+	if r.Raw["top"] == "" {
+		n, err := r.db().MemoryUsage(r.Key)
+		if err != nil { return NewResponse("", err) }
+		return NewResponse(fmt.Sprintf("%d", n), nil)
+	}
+	count, err := strconv.Atoi(r.Raw["count"])
+	if err != nil {
+		count = DefaultMemoryTop
+	}
+	keys, err := r.db().BiggestKeys(count)
+	if err != nil { return NewResponse("", err) }
+	pairs := []string{}
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s:%d", k.Key, k.Size))
+	}
+	return NewResponse(strings.Join(pairs, " "), nil)
+}
+
+// Database routes
+
+func routeSelect(r *Request) *Response {
+	i, err := strconv.Atoi(r.Key)
+	if err != nil { return NewResponse("", ErrBadDB) }
+	if _, err = r.databases().Get(i); err != nil { return NewResponse("", err) }
+	if r.session == nil { return NewResponse("", ErrNoSession) }
+	r.session.db = i
+	return NewResponse("[204]", nil)
+}
+
+func routeDBSize(r *Request) *Response {
+	return NewResponse(fmt.Sprintf("%d", r.db().Len()), nil)
+}
+
+// routeMove moves key from current database to another
+func routeMove(r *Request) *Response {
+	i, err := strconv.Atoi(r.Value)
+	if err != nil { return NewResponse("", ErrBadDB) }
+	dst, err := r.databases().Get(i)
+	if err != nil { return NewResponse("", err) }
+	if err = r.db().Move(r.Key, dst); err != nil { return NewResponse("", err) }
+	return NewResponse("[204]", nil)
+}
@@ -1,93 +1,480 @@
 package server
 
 import (
+	"io"
+	"os"
 	"fmt"
 	"net"
+	"sync"
+	"time"
 	"bufio"
+	"context"
+	"crypto/tls"
+	"sync/atomic"
+	"github.com/avsolo/gache/lib"
 )
 
 // Server is main struct consist method to manage TCP income connections
-// and writing response.
+// and writing response. Address prefixed with UnixPrefix makes Server
+// listen Unix domain socket instead of TCP
 type Server struct {
-    conn *net.Conn
 	addr string
 	KeepAlive bool
+	// SocketPerm is permissions of Unix socket file
+	SocketPerm os.FileMode
+	// IdleTimeout limits time of waiting for next command
+	IdleTimeout time.Duration
+	// ReadTimeout limits time of reading one command after first byte
+	ReadTimeout time.Duration
+	// WriteTimeout limits time of writing one response
+	WriteTimeout time.Duration
+	// MaxLineLength is max size of request in bytes. Longer requests are
+	// rejected and connection closed
+	MaxLineLength int
+	// MaxConns limits number of client connections (0 - unlimited)
+	MaxConns int
+	// MaxConnsPerIP limits number of connections from one IP (0 - unlimited)
+	MaxConnsPerIP int
+	// RateLimit is number of commands per second allowed for one connection
+	// or IP depending on RateLimitBy (0 - unlimited). RateBurst commands can
+	// be executed at once
+	RateLimit float64
+	RateBurst int
+	RateLimitBy string
+	// ACL enables authentication. Clients must send AUTH before other
+	// commands and can run only commands allowed for their user
+	ACL *ACL
+	// TLSConfig enables TLS for all connections, see ServerTLSConfig
+	TLSConfig *tls.Config
+	// SlowLogThreshold is min duration of command saved in slow log
+	// (0 - slow log disabled). SlowLogMax newest entries are kept
+	SlowLogThreshold time.Duration
+	SlowLogMax int
+	current atomic.Value // *Settings, see Reload
+	limits *limiter
+	rejects chan struct{} // Semaphore of replies to rejected connections
+	commands map[string]*int64 // Processed commands counters
+	metrics *metrics
+	slowlog *slowLog
+	dbs *databases // Nil if package databases served
+	ownDBs bool // Databases closed by Shutdown
+	pubsub *broker
+	log lib.LoggerInterface
+	started time.Time
+	lock sync.Mutex
+	ln net.Listener
+	conns map[net.Conn]bool // Connection is active while command executed
+	closing bool
+	wg sync.WaitGroup
 }
 
-// NewServer create and return Server instance
-func NewServer(addr string) *Server {
-	return &Server{addr: addr, KeepAlive: false}
+// NewServer create and return Server instance. By default Server serves
+// package databases, options can give it own ones, e.g.
+// NewServer(addr, WithDatabases(16, storage.WithMaxMemory(1 << 30)))
+func NewServer(addr string, opts ...Option) *Server {
+	srv := &Server{
+		addr: addr,
+		KeepAlive: false,
+		RateLimitBy: LimitByConn,
+		SocketPerm: DefaultSocketPerm,
+		conns: map[net.Conn]bool{},
+		limits: newLimiter(),
+		rejects: make(chan struct{}, MaxRejects),
+		commands: newCommandCounters(),
+		metrics: newMetrics(),
+		slowlog: &slowLog{},
+		SlowLogMax: DefaultSlowLogMax,
+		pubsub: newBroker(),
+		log: log,
+	}
+	for _, opt := range opts {
+		opt(srv)
+	}
+	return srv
+}
+
+// databases returns databases served by Server
+func (s *Server) databases() *databases {
+	if s.dbs != nil {
+		return s.dbs
+	}
+	return packageDatabases()
 }
 
-// ListenTCP starts listen TCP connections
-func (s *Server) ListenTCP() {
-	ln, err := net.Listen("tcp", s.addr)
+// ListenTCP starts listen TCP (or Unix socket) connections. It returns
+// ErrServerClosed after Shutdown or Stop called
+func (s *Server) ListenTCP() error {
+	network, addr := parseAddr(s.addr)
+	var ln net.Listener
+	var err error
+	if network == "unix" {
+		ln, err = listenUnix(addr, s.SocketPerm)
+	} else {
+		ln, err = net.Listen(network, addr)
+	}
 	if err != nil {
-		log.Fatalf("listen error: %v", err)
+		s.log.Errorw("Listen error", "addr", s.addr, "err", err)
+		return err
 	}
-	log.Debugf("Server started at %s", s.addr)
-    conns := s.clientConns(ln)
+	if s.TLSConfig != nil {
+		ln = tls.NewListener(ln, s.TLSConfig)
+	}
+	s.lock.Lock()
+	if s.closing {
+		s.lock.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.ln = ln
+	s.started = time.Now()
+	if s.current.Load() == nil {
+		s.current.Store(s.fieldSettings())
+	}
+	s.lock.Unlock()
+	s.log.Infow("Server started", "addr", s.addr)
+
 	for {
-        go s.handleConn(<-conns)
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.isClosing() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				s.log.Warnw("Couldn't accept", "err", err)
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			s.log.Errorw("Couldn't accept", "err", err)
+			return err
+		}
+		if err := s.limits.connect(s.settings(), conn); err != nil {
+			s.log.Warnw("Connection rejected", "addr", conn.RemoteAddr(), "err", err)
+			s.metrics.error(503)
+			select {
+			case s.rejects <- struct{}{}:
+				go s.reject(conn, err)
+			default:
+				conn.Close() // Too many replies in progress, flood
+			}
+			continue
+		}
+		atomic.AddInt64(&s.metrics.accepted, 1)
+		if !s.track(conn) {
+			s.limits.disconnect(conn)
+			conn.Close()
+			continue
+		}
+		go s.handleConn(conn)
 	}
 }
 
-func (s *Server) Stop() {
-    (*s.conn).Close()
-}
-
-// clientConns starts waiting client connections and write them
-// to the channed for next handler
-func (s *Server) clientConns(ln net.Listener) chan net.Conn {
-    ch := make(chan net.Conn)
-    go func() {
-        for {
-            conn, err := ln.Accept()
-            if conn == nil {
-                log.Errorf("Couldn't accept: " + err.Error())
-                continue
-            }
-            ch <- conn
-        }
-    }()
-    return ch
-}
+// rejectTimeout limits time spent on reply to rejected connection
+const rejectTimeout = time.Second
 
-// handleConn get one client connection read, validate and write response
-func (s *Server) handleConn(conn net.Conn) {
+// MaxRejects is max number of rejected connections replied at once. Over
+// it rejected connections are closed without reply, so connection flood
+// can't spawn unlimited goroutines. It's read by NewServer
+var MaxRejects = 64
+
+// reject replies error to connection rejected by limits and closes it. It
+// runs in own goroutine with short deadline, so TLS handshake with client
+// which never sends anything doesn't block accept loop
+func (s *Server) reject(conn net.Conn, err error) {
 	defer func() {
-		if s.KeepAlive { return }
 		conn.Close()
+		<-s.rejects
+	}()
+	conn.SetDeadline(time.Now().Add(rejectTimeout))
+	conn.Write([]byte(fmt.Sprintf("[%d] %s\n", 503, err.Error())))
+}
+
+// Shutdown stops accepting new connections, closes idle ones and waits
+// for commands in progress till ctx is done. After that rest connections
+// are closed and databases saved with Persister if it set. Databases
+// created by WithDatabases are closed
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lock.Lock()
+	if s.closing {
+		s.lock.Unlock()
+		return ErrServerClosed
+	}
+	s.closing = true
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	for conn, active := range s.conns {
+		if !active {
+			conn.Close()
+		}
+	}
+	s.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
 	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.lock.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.lock.Unlock()
+		err = ctx.Err()
+	}
+
+	for i, db := range s.databases().list {
+		save := db.Snapshot
+		if s.ownDBs {
+			save = db.Close // Saves data too
+		}
+		if e := save(); e != nil {
+			s.log.Errorw("Unable save database", "db", i, "err", e)
+			err = e
+		}
+	}
+	s.log.Infow("Server stopped", "addr", s.addr)
+	return err
+}
+
+// Stop closes listener and all connections immediately
+func (s *Server) Stop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Shutdown(ctx)
+}
+
+// Counters returns number of connections and commands rejected by limits
+func (s *Server) Counters() Counters {
+	return s.limits.Counters()
+}
+
+func (s *Server) isClosing() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closing
+}
+
+// track starts tracking of new connection. Returns false if server is
+// shutting down
+func (s *Server) track(conn net.Conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closing {
+		return false
+	}
+	s.conns[conn] = false
+	s.wg.Add(1)
+	return true
+}
+
+// untrack closes connection and stops tracking it
+func (s *Server) untrack(conn net.Conn) {
+	conn.Close()
+	s.limits.disconnect(conn)
+	s.lock.Lock()
+	delete(s.conns, conn)
+	s.lock.Unlock()
+	s.wg.Done()
+}
+
+// setActive marks connection as executing command or idle. Returns false
+// if connection going idle while server is shutting down
+func (s *Server) setActive(conn net.Conn, active bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closing && !active {
+		return false
+	}
+	s.conns[conn] = active
+	return true
+}
+
+// handleConn get one client connection read, validate and write response.
+// If KeepAlive set, connection served until client closes it
+func (s *Server) handleConn(conn net.Conn) {
+	defer s.untrack(conn)
+	st := s.settings()
+	sess := &session{acl: st.ACL, srv: s}
+	bucket := s.limits.bucket(st, conn)
     b := bufio.NewReader(conn)
     for {
-        line, err := b.ReadBytes('\n')
+		if !s.setActive(conn, false) {
+			break // Shutting down
+		}
+        line, err := s.readLine(conn, b)
+        if err == io.EOF || s.isClosing() {
+			break // Client or server closed connection
+        }
+        if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			s.log.Debugw("Connection timed out", "addr", conn.RemoteAddr())
+			break
+        }
+        if err == ErrLineTooLong {
+			s.writeErr(conn, 400, err)
+			break
+        }
         if err != nil {
-            log.Warnf("Error reading bytes: %s", err.Error())
-			writeErr(conn, 500, err)
-            if s.KeepAlive { continue }
+            s.log.Warnw("Error reading bytes", "addr", conn.RemoteAddr(), "err", err)
+			s.writeErr(conn, 500, err)
 			break
         }
 
+		s.setActive(conn, true)
+		if !s.limits.allow(bucket) {
+			s.writeErr(conn, 429, ErrRateLimit)
+			if s.KeepAlive { continue }
+			break
+		}
 		r, err := NewRequest(string(line))
 		if err != nil {
-			writeErr(conn, 400, err)
+			s.writeErr(conn, 400, err)
 			if s.KeepAlive { continue }
 			break
 		}
 
+		if err := sess.authorize(r); err != nil {
+			code := 403
+			if err == ErrAuthRequired { code = 401 }
+			s.writeErr(conn, code, err)
+			if s.KeepAlive { continue }
+			break
+		}
+
+		r.session = sess
+		atomic.AddInt64(s.commands[r.Cmd], 1)
+		start := time.Now()
 		resp := r.Route()
+		s.observe(conn, r, start)
 		if resp.Error != nil {
-			writeErr(conn, 400, resp.Error)
+			s.writeErr(conn, 400, resp.Error)
 			if s.KeepAlive { continue }
 			break
 		}
-		conn.Write([]byte(resp.Body + "\n"))
-        if !s.KeepAlive { break }
+		if resp.push != nil {
+			if s.setActive(conn, false) { // Push mode closed on shutdown
+				s.push(conn, b, resp)
+			} else {
+				resp.push.stop()
+			}
+			break
+		}
+		s.write(conn, resp.Body)
+		if !s.KeepAlive && r.Cmd != CMD_AUTH {
+			break // Without KeepAlive AUTH is followed by one command
+		}
     }
 }
 
+// push switches connection to push mode. Body of resp written first, then
+// all lines queued by subscriber until client disconnects or subscriber
+// stopped. Commands received in push mode executed by subscriber.
+// Connection is closed after that
+func (s *Server) push(conn net.Conn, b *bufio.Reader, resp *Response) {
+	sub := resp.push
+	defer func() {
+		sub.stop()
+		conn.Close()
+	}()
+	tooLong := make(chan struct{})
+	go func() {
+		for {
+			line, err := readBounded(b, s.settings().MaxLineLength)
+			if err == ErrLineTooLong {
+				close(tooLong)
+				return
+			}
+			if err != nil {
+				sub.stop()
+				return
+			}
+			sub.handle(string(line))
+		}
+	}()
+
+	conn.SetReadDeadline(time.Time{}) // Subscriber can be idle as long as it needs
+	if err := s.write(conn, resp.Body); err != nil {
+		return
+	}
+	for {
+		select {
+		case <-sub.done:
+			return
+		case <-tooLong:
+			s.writeErr(conn, 400, ErrLineTooLong)
+			return
+		case msg := <-sub.out:
+			if err := s.write(conn, msg); err != nil {
+				s.log.Debugw("Push write error", "addr", conn.RemoteAddr(), "err", err)
+				return
+			}
+		}
+	}
+}
+
+// observe saves command latency to metrics and slow log
+func (s *Server) observe(conn net.Conn, r *Request, start time.Time) {
+	d := time.Since(start)
+	s.metrics.observe(r.Cmd, d)
+	st := s.settings()
+	if st.SlowLogThreshold > 0 && d >= st.SlowLogThreshold {
+		s.slowlog.add(&SlowLogEntry{Time: start, Duration: d,
+			Addr: conn.RemoteAddr().String(), Cmd: r.Cmd, Key: r.Key}, st.SlowLogMax)
+	}
+}
+
+// readLine reads one request line. It waits IdleTimeout for first byte and
+// ReadTimeout for the rest of line. Line longer than MaxLineLength rejected
+// with ErrLineTooLong
+func (s *Server) readLine(conn net.Conn, b *bufio.Reader) ([]byte, error) {
+	st := s.settings()
+	conn.SetReadDeadline(deadline(st.IdleTimeout))
+	if _, err := b.Peek(1); err != nil {
+		return nil, err
+	}
+	st = s.settings()
+	conn.SetReadDeadline(deadline(st.ReadTimeout))
+	return readBounded(b, st.MaxLineLength)
+}
+
+// readBounded reads line up to max bytes (0 - unlimited). Longer line is
+// rejected with ErrLineTooLong before it's buffered
+func readBounded(b *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := b.ReadSlice('\n')
+		if max > 0 && len(line) + len(chunk) > max {
+			return nil, ErrLineTooLong
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return line, err
+	}
+}
+
+// write writes one response line within WriteTimeout
+func (s *Server) write(conn net.Conn, msg string) error {
+	conn.SetWriteDeadline(deadline(s.settings().WriteTimeout))
+	_, err := conn.Write([]byte(msg + "\n"))
+	return err
+}
+
 // writeErr is shotrcut for response error writing
-func writeErr(conn net.Conn, code int, err error) {
-	conn.Write([]byte(fmt.Sprintf("[%d] %s\n", code, err.Error())))
+func (s *Server) writeErr(conn net.Conn, code int, err error) {
+	s.metrics.error(code)
+	s.write(conn, fmt.Sprintf("[%d] %s", code, err.Error()))
+}
+
+// deadline returns time after timeout from now or zero time (no deadline)
+// for non-positive timeout
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
 }
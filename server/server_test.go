@@ -1,31 +1,67 @@
 package server
 
 import (
+    "io"
+    "os"
     "fmt"
+    "context"
+    "net"
     "time"
+    "strings"
 	"testing"
+    "math/big"
+    "io/ioutil"
+    "crypto/rand"
+    "crypto/ecdsa"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "crypto/elliptic"
+    "encoding/pem"
+    "path/filepath"
+    "net/http/httptest"
     "github.com/stretchr/testify/assert"
 
 	"github.com/avsolo/gache/lib"
     "github.com/avsolo/gache/server"
+    "github.com/avsolo/gache/storage"
 )
 
 var _s = fmt.Sprintf
 var log *lib.Logger
-var addr = lib.CliParams.ServerAddr
+var addr = lib.NewConfig().ServerAddr
 var srv = server.NewServer(addr)
 var cln *server.Client
 
+// Kept alive server and client
+var kaAddr = "127.0.0.1:8810"
+var kaSrv = server.NewServer(kaAddr)
+var kaCln *server.Client
+
 func init() {
 	log = lib.NewLogger("server_test")
+    server.PasswordIterations = 1000 // Hashes made by tests needn't be slow
     go func() {
         srv.ListenTCP()
         log.Info("Server stopped")
     }()
+    kaSrv.KeepAlive = true
+    go kaSrv.ListenTCP()
     // Sometimest client trying connect before server start.
     // So, we just wait a bit
     time.Sleep(time.Duration(100 * time.Microsecond))
     cln = server.NewClient(addr)
+    kaCln = server.NewClient(kaAddr)
+    kaCln.KeepAlive = true
+}
+
+// waitFor polls cond till it's true failing test after second
+func waitFor(t *testing.T, cond func() bool, msg string) {
+    assert.Eventually(t, cond, time.Second, time.Millisecond, msg)
+}
+
+// waitStarted waits till server listens
+func waitStarted(t *testing.T, s *server.Server) {
+    waitFor(t, func() bool { return s.Info().Uptime > 0 }, "Server not started")
 }
 
 // checkGet is shortcut for GET request and asserting expected value
@@ -177,3 +213,1002 @@ func TestDSET(t *testing.T) {
     assert.Nil(t, err)
     assert.Regexp(t, `\[400\]\s*`, res)
 }
+
+// TTL
+func TestTTL(t *testing.T) {
+    cln.Send("OPT flush")
+    k1, v1, t1 := "k1", "val1", 100
+
+    _, _ = cln.Sendf("SET %s %s %d", k1, v1, t1)
+    ttl, err := cln.TTL(k1)
+    assert.Nil(t, err)
+    assert.True(t, ttl > 90 && ttl <= t1, _s("Wrong TTL: %d", ttl))
+
+    // Relative TTL
+    err = cln.Expire(k1, 20)
+    assert.Nil(t, err)
+    ttl, err = cln.TTL(k1)
+    assert.True(t, ttl > 10 && ttl <= 20, _s("Wrong TTL: %d", ttl))
+
+    // Absolute TTL
+    err = cln.ExpireAt(k1, time.Now().Add(50 * time.Second))
+    assert.Nil(t, err)
+    ttl, err = cln.TTL(k1)
+    assert.True(t, ttl > 40 && ttl <= 50, _s("Wrong TTL: %d", ttl))
+
+    // Remove expire
+    err = cln.Persist(k1)
+    assert.Nil(t, err)
+    res, err := cln.Sendf("TTL %s", k1)
+    assert.Nil(t, err)
+    assert.Equal(t, "-1", res)
+    _, err = cln.TTL(k1)
+    assert.Equal(t, storage.ErrNoExpire, err)
+
+    // Zero TTL also means no expire
+    err = cln.Expire(k1, 20)
+    err = cln.Expire(k1, 0)
+    assert.Nil(t, err)
+    _, err = cln.TTL(k1)
+    assert.Equal(t, storage.ErrNoExpire, err)
+    checkGet(t, k1, v1)
+
+    // Unknown key
+    err = cln.Expire("unknown", 10)
+    assert.Equal(t, storage.ErrNotFound, err)
+}
+
+// Keyspace notifications
+func TestKSUBSCRIBE(t *testing.T) {
+    cln.Send("OPT flush")
+    es, err := cln.SubscribeKeys("sub*", storage.EventSet, storage.EventDelete)
+    assert.Nil(t, err)
+    defer es.Close()
+
+    _, _ = cln.Sendf("SET %s %s %d", "other", "val", 100)
+    _, _ = cln.Sendf("SET %s %s %d", "sub1", "val", 100)
+    _, _ = cln.Sendf("UPD %s %s %d", "sub1", "val2", 100)
+    _, _ = cln.Sendf("DEL %s", "sub1")
+
+    for _, exp := range []storage.Event{
+        {Type: storage.EventSet, Key: "sub1"},
+        {Type: storage.EventDelete, Key: "sub1"},
+    } {
+        select {
+        case e := <-es.C:
+            assert.Equal(t, exp, e)
+        case <-time.After(time.Second):
+            t.Errorf("Event %v not received", exp)
+        }
+    }
+
+    _, err = cln.SubscribeKeys("sub*", "unknown")
+    assert.Equal(t, storage.ErrBadEvent, err)
+}
+
+// Pub/Sub
+func checkMessage(t *testing.T, ps *server.PubSub, expected server.Message) {
+    select {
+    case m := <-ps.C:
+        assert.Equal(t, expected, *m)
+    case <-time.After(time.Second):
+        t.Errorf("Message %v not received", expected)
+    }
+}
+
+func TestPUBLISH(t *testing.T) {
+    ps, err := cln.Subscribe("ch1", "ch2")
+    assert.Nil(t, err)
+    defer ps.Close()
+    pps, err := cln.PSubscribe("news.*")
+    assert.Nil(t, err)
+    defer pps.Close()
+
+    n, err := cln.Publish("ch1", "hello world")
+    assert.Nil(t, err)
+    assert.Equal(t, 1, n)
+    checkMessage(t, ps, server.Message{Channel: "ch1", Payload: "hello world"})
+
+    n, err = cln.Publish("news.sport", "goal")
+    assert.Nil(t, err)
+    assert.Equal(t, 1, n)
+    checkMessage(t, pps, server.Message{Channel: "news.sport", Pattern: "news.*", Payload: "goal"})
+
+    // Subscribe more in push mode
+    err = ps.Unsubscribe("ch1")
+    assert.Nil(t, err)
+    err = ps.Subscribe("ch3")
+    assert.Nil(t, err)
+    waitFor(t, func() bool {
+        n, _ = cln.Publish("ch3", "msg3")
+        return n == 1 // So ch1 unsubscribed before
+    }, "Not subscribed to ch3")
+    n, _ = cln.Publish("ch1", "lost")
+    assert.Equal(t, 0, n)
+    checkMessage(t, ps, server.Message{Channel: "ch3", Payload: "msg3"})
+
+    // Connection close unsubscribes all
+    ps.Close()
+    pps.Close()
+    waitFor(t, func() bool {
+        n, _ = cln.Publish("ch2", "nobody")
+        return n == 0
+    }, "Subscribers not removed")
+}
+
+func TestPUBLISHSlowSubscriber(t *testing.T) {
+    buf := server.PushBuffer
+    server.PushBuffer = 2
+    defer func() { server.PushBuffer = buf }()
+
+    // Subscriber never reads its connection
+    conn, err := net.Dial("tcp", addr)
+    assert.Nil(t, err)
+    defer conn.Close()
+    conn.Write([]byte("SUBSCRIBE slow\r\n"))
+    waitFor(t, func() bool {
+        n, _ := cln.Publish("slow", "ping")
+        return n == 1
+    }, "Not subscribed")
+
+    payload := strings.Repeat("x", 10000)
+    dropped := false
+    for i := 0; i < 5000; i++ {
+        n, err := cln.Publish("slow", payload)
+        assert.Nil(t, err)
+        if n == 0 {
+            dropped = true
+            break
+        }
+    }
+    assert.True(t, dropped, "Slow subscriber not disconnected")
+}
+
+// Keys
+func TestKEYS(t *testing.T) {
+    cln.Send("OPT flush")
+    _, _ = cln.Sendf("SET %s %s %d", "user1", "val", 100)
+    _, _ = cln.Sendf("SET %s %s %d", "user2", "val", 100)
+    _, _ = cln.Sendf("LSET %s %s %d", "list", "v1 v2", 100)
+
+    keys, err := cln.Keys("user*")
+    assert.Nil(t, err)
+    assert.Equal(t, []string{"user1", "user2"}, keys)
+
+    n, err := cln.Exists("user1", "list", "unknown")
+    assert.Nil(t, err)
+    assert.Equal(t, 2, n)
+
+    typ, err := cln.Type("list")
+    assert.Nil(t, err)
+    assert.Equal(t, "list", typ)
+    _, err = cln.Type("unknown")
+    assert.Equal(t, storage.ErrNotFound, err)
+
+    err = cln.Rename("user1", "user3")
+    assert.Nil(t, err)
+    checkGet(t, "user3", "val")
+
+    key, err := cln.RandomKey()
+    assert.Nil(t, err)
+    assert.NotEqual(t, "", key)
+
+    // Scan all keys by 2
+    found, cursor := []string{}, storage.ScanStart
+    for {
+        next, keys, err := cln.Scan(cursor, "*", 2)
+        assert.Nil(t, err)
+        found = append(found, keys...)
+        if cursor = next; cursor == storage.ScanStart {
+            break
+        }
+    }
+    assert.Equal(t, []string{"list", "user2", "user3"}, found)
+}
+
+func TestTSET(t *testing.T) {
+    cln.Send("OPT flush")
+    assert.Nil(t, cln.SetTagged("user1_name", "Bob Smith", 100, "user:1", "names"))
+    assert.Nil(t, cln.SetTagged("user1_mail", "bob", 100, "user:1"))
+    assert.Nil(t, cln.SetTagged("user2_name", "Ann", 100, "names"))
+    checkGet(t, "user1_name", "Bob Smith")
+    assert.Equal(t, storage.ErrAlreadyExists, cln.SetTagged("user1_name", "x", 100, "names"))
+
+    n, err := cln.InvalidateTag("user:1")
+    assert.Nil(t, err)
+    assert.Equal(t, 2, n)
+    n, err = cln.Exists("user1_name", "user2_name")
+    assert.Equal(t, 1, n)
+
+    n, err = cln.DeleteByPrefix("user2")
+    assert.Nil(t, err)
+    assert.Equal(t, 1, n)
+    n, _ = cln.InvalidateTag("names")
+    assert.Equal(t, 0, n)
+}
+
+func TestMEMORY(t *testing.T) {
+    cln.Send("OPT flush")
+    _, _ = cln.Sendf("SET %s %s %d", "small", "v", 100)
+    _, _ = cln.Sendf("SET %s %s %d", "big", strings.Repeat("v", 500), 100)
+    _, _ = cln.Sendf("SET %s %s %d", "medium", strings.Repeat("v", 100), 100)
+
+    n, err := cln.MemoryUsage("big")
+    assert.Nil(t, err)
+    assert.True(t, n > 500)
+    _, err = cln.MemoryUsage("unknown")
+    assert.Equal(t, storage.ErrNotFound, err)
+
+    top, err := cln.BiggestKeys(2)
+    assert.Nil(t, err)
+    assert.Equal(t, 2, len(top))
+    assert.Equal(t, storage.KeySize{Key: "big", Size: n}, top[0])
+    assert.Equal(t, "medium", top[1].Key)
+
+    res, err := cln.Send("MEMORY TOP")
+    assert.Nil(t, err)
+    assert.Equal(t, 3, len(strings.Fields(res)))
+}
+
+// Databases
+func TestSELECT(t *testing.T) {
+    cln.Send("OPT flushall")
+    defer kaCln.Close()
+
+    // Without kept alive connection SELECT is useless
+    err := cln.Select(1)
+    assert.Equal(t, server.ErrNoKeepAlive, err)
+
+    _, _ = kaCln.Sendf("SET %s %s %d", "k1", "db0", 100)
+    err = kaCln.Select(1)
+    assert.Nil(t, err)
+    res, err := kaCln.Sendf("GET %s", "k1")
+    assert.Regexp(t, `\[400\]\s*`, res)
+    _, _ = kaCln.Sendf("SET %s %s %d", "k1", "db1", 100)
+    _, _ = kaCln.Sendf("SET %s %s %d", "k2", "db1", 100)
+    n, err := kaCln.DBSize()
+    assert.Nil(t, err)
+    assert.Equal(t, 2, n)
+
+    // Move to db 2 and check there
+    err = kaCln.Move("k2", 2)
+    assert.Nil(t, err)
+    err = kaCln.Move("k1", 0)
+    assert.Equal(t, storage.ErrAlreadyExists, err)
+    err = kaCln.Select(2)
+    assert.Nil(t, err)
+    res, _ = kaCln.Sendf("GET %s", "k2")
+    assert.Equal(t, "db1", res)
+
+    // Flush current database only
+    _, _ = kaCln.Send("OPT flush")
+    n, _ = kaCln.DBSize()
+    assert.Equal(t, 0, n)
+    err = kaCln.Select(1)
+    n, _ = kaCln.DBSize()
+    assert.Equal(t, 1, n)
+
+    // Selected database restored after reconnect
+    kaCln.Close()
+    res, _ = kaCln.Sendf("GET %s", "k1")
+    assert.Equal(t, "db1", res)
+
+    err = kaCln.Select(1000)
+    assert.Equal(t, server.ErrBadDB, err)
+    err = kaCln.Select(0)
+    assert.Nil(t, err)
+    checkGet(t, "k1", "db0")
+}
+
+// Shutdown
+type testPersister struct {
+    called chan struct{}
+}
+
+func (p *testPersister) Persist(items []storage.ItemInterface) error {
+    close(p.called)
+    return nil
+}
+
+func TestShutdown(t *testing.T) {
+    sAddr := "127.0.0.1:8820"
+    s := server.NewServer(sAddr)
+    s.KeepAlive = true
+    listenErr := make(chan error)
+    go func() { listenErr <- s.ListenTCP() }()
+    waitStarted(t, s)
+
+    p := &testPersister{called: make(chan struct{})}
+    server.Store().SetPersister(p)
+    defer server.Store().SetPersister(nil)
+
+    // Idle kept alive connection
+    c := server.NewClient(sAddr)
+    c.KeepAlive = true
+    res, err := c.Send("PING")
+    assert.Nil(t, err)
+    assert.Equal(t, "PONG", res)
+
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+    defer cancel()
+    err = s.Shutdown(ctx)
+    assert.Nil(t, err)
+    assert.Equal(t, server.ErrServerClosed, <-listenErr)
+
+    // Snapshot saved
+    select {
+    case <-p.called:
+    default:
+        t.Errorf("Snapshot not saved")
+    }
+
+    // Idle connection closed and new ones not accepted
+    _, err = c.Send("PING")
+    assert.NotNil(t, err)
+    _, err = net.Dial("tcp", sAddr)
+    assert.NotNil(t, err)
+    assert.Equal(t, server.ErrServerClosed, s.Shutdown(ctx))
+}
+
+// Timeouts and limits
+func TestTimeouts(t *testing.T) {
+    sAddr := "127.0.0.1:8821"
+    s := server.NewServer(sAddr)
+    s.KeepAlive = true
+    s.IdleTimeout = 100 * time.Millisecond
+    s.ReadTimeout = 100 * time.Millisecond
+    s.MaxLineLength = 100
+    go s.ListenTCP()
+    defer s.Stop()
+    waitStarted(t, s)
+
+    // Idle connection closed
+    conn, err := net.Dial("tcp", sAddr)
+    assert.Nil(t, err)
+    conn.SetReadDeadline(time.Now().Add(time.Second))
+    _, err = conn.Read(make([]byte, 10))
+    assert.Equal(t, io.EOF, err, "Idle connection not closed")
+    conn.Close()
+
+    // Not finished request
+    conn, err = net.Dial("tcp", sAddr)
+    assert.Nil(t, err)
+    conn.Write([]byte("GET k"))
+    conn.SetReadDeadline(time.Now().Add(time.Second))
+    _, err = conn.Read(make([]byte, 10))
+    assert.Equal(t, io.EOF, err, "Slow connection not closed")
+    conn.Close()
+
+    // Too long request
+    c := server.NewClient(sAddr)
+    res, err := c.Sendf("SET k %s 10", strings.Repeat("x", 200))
+    assert.Nil(t, err)
+    assert.Equal(t, "[400] Request too long", res)
+    res, err = c.Send("PING")
+    assert.Equal(t, "PONG", res)
+
+    // Too long line in push mode closes connection
+    conn, err = net.Dial("tcp", sAddr)
+    assert.Nil(t, err)
+    defer conn.Close()
+    conn.Write([]byte("SUBSCRIBE ch\n"))
+    conn.SetReadDeadline(time.Now().Add(time.Second))
+    _, err = conn.Read(make([]byte, 100))
+    assert.Nil(t, err)
+    go conn.Write([]byte(strings.Repeat("x", 1 << 20)))
+    _, err = ioutil.ReadAll(conn)
+    if ne, ok := err.(net.Error); ok {
+        assert.False(t, ne.Timeout(), "Push connection not closed")
+    }
+}
+
+func TestLimits(t *testing.T) {
+    sAddr := "127.0.0.1:8822"
+    s := server.NewServer(sAddr)
+    s.KeepAlive = true
+    s.MaxConns = 2
+    s.RateLimit = 1
+    s.RateBurst = 2
+    go s.ListenTCP()
+    defer s.Stop()
+    waitStarted(t, s)
+
+    // Rate limit per connection
+    c1 := server.NewClient(sAddr)
+    c1.KeepAlive = true
+    defer c1.Close()
+    for i := 0; i < 2; i++ {
+        res, _ := c1.Send("PING")
+        assert.Equal(t, "PONG", res)
+    }
+    res, _ := c1.Send("PING")
+    assert.Equal(t, "[429] Rate limit exceeded", res)
+
+    // Max connections
+    c2 := server.NewClient(sAddr)
+    c2.KeepAlive = true
+    defer c2.Close()
+    res, _ = c2.Send("PING")
+    assert.Equal(t, "PONG", res)
+    res, _ = server.NewClient(sAddr).Send("PING")
+    assert.Equal(t, "[503] Too many connections", res)
+
+    cnt := s.Counters()
+    assert.Equal(t, int64(1), cnt.RejectedConns)
+    assert.Equal(t, int64(1), cnt.RateLimited)
+}
+
+func TestLimitsPerIP(t *testing.T) {
+    sAddr := "127.0.0.1:8823"
+    s := server.NewServer(sAddr)
+    s.KeepAlive = true
+    s.MaxConnsPerIP = 1
+    s.RateLimit = 1
+    s.RateBurst = 1
+    s.RateLimitBy = server.LimitByIP
+    go s.ListenTCP()
+    defer s.Stop()
+    waitStarted(t, s)
+
+    c1 := server.NewClient(sAddr)
+    c1.KeepAlive = true
+    res, _ := c1.Send("PING")
+    assert.Equal(t, "PONG", res)
+    res, _ = server.NewClient(sAddr).Send("PING")
+    assert.Equal(t, "[503] Too many connections from IP", res)
+    c1.Close()
+    waitFor(t, func() bool { return s.Info().Clients == 0 }, "Connection not closed")
+
+    // Bucket shared by all connections from IP
+    res, _ = server.NewClient(sAddr).Send("PING")
+    assert.Equal(t, "[429] Rate limit exceeded", res)
+    assert.Equal(t, int64(1), s.Counters().RejectedIPConns)
+}
+
+func TestLimitsReload(t *testing.T) {
+    sAddr := "127.0.0.1:8833"
+    s := server.NewServer(sAddr)
+    s.KeepAlive = true
+    s.RateLimit = 1
+    s.RateBurst = 1
+    go s.ListenTCP()
+    defer s.Stop()
+    waitStarted(t, s)
+
+    // IP connected while limited by connection gets bucket after reload
+    c1 := server.NewClient(sAddr)
+    c1.KeepAlive = true
+    defer c1.Close()
+    res, _ := c1.Send("PING")
+    assert.Equal(t, "PONG", res)
+    st := s.Settings()
+    st.RateLimitBy = server.LimitByIP
+    s.Reload(st)
+    c2 := server.NewClient(sAddr)
+    c2.KeepAlive = true
+    defer c2.Close()
+    res, _ = c2.Send("PING")
+    assert.Equal(t, "PONG", res)
+    res, _ = c2.Send("PING")
+    assert.Equal(t, "[429] Rate limit exceeded", res)
+}
+
+func TestAuth(t *testing.T) {
+    sAddr := "127.0.0.1:8824"
+    s := server.NewServer(sAddr)
+    s.ACL = server.NewACL()
+    s.ACL.AddUser(server.NewDefaultUser("secret"))
+    s.ACL.AddUser(server.NewUser("reader", server.HashPassword("pass"),
+        []string{server.CatRead}, []string{"user_*"}))
+    go s.ListenTCP()
+    defer s.Stop()
+    waitStarted(t, s)
+
+    c := server.NewClient(sAddr)
+    res, _ := c.Send("GET user_1")
+    assert.Equal(t, "[401] Authentication required", res)
+    assert.Equal(t, server.ErrAuthFailed, c.Auth("", "wrong"))
+
+    // Without KeepAlive every connection authenticated before command
+    assert.Nil(t, c.Auth("", "secret"))
+    _, err := c.Call("SET user_1 val 0")
+    assert.Nil(t, err)
+    _, err = c.Call("SET admin_1 val 0")
+    assert.Nil(t, err)
+
+    r := server.NewClient(sAddr)
+    assert.Nil(t, r.Auth("reader", "pass"))
+    res, err = r.Call("GET user_1")
+    assert.Nil(t, err)
+    assert.Equal(t, "val", res)
+    _, err = r.Call("GET admin_1")
+    assert.Equal(t, server.ErrNoPerm, err)
+    _, err = r.Call("SET user_2 val 0")
+    assert.Equal(t, server.ErrNoPerm, err)
+    _, err = r.Call("OPT flush")
+    assert.Equal(t, server.ErrNoPerm, err)
+    keys, err := r.Keys("*")
+    assert.Nil(t, err)
+    assert.Equal(t, []string{"user_1"}, keys)
+    keys, err = r.Keys("user_*")
+    assert.Nil(t, err)
+    assert.Equal(t, []string{"user_1"}, keys)
+
+    // Streams are authenticated too
+    _, err = r.Subscribe("news")
+    assert.Equal(t, server.ErrNoPerm, err)
+    ps, err := c.Subscribe("news")
+    assert.Nil(t, err)
+    ps.Close()
+}
+
+func TestAuthKeyPatterns(t *testing.T) {
+    sAddr := "127.0.0.1:8832"
+    s := server.NewServer(sAddr)
+    s.ACL = server.NewACL()
+    s.ACL.AddUser(server.NewDefaultUser("secret"))
+    s.ACL.AddUser(server.NewUser("limited", server.HashPassword("pass"),
+        []string{server.CatRead, server.CatWrite, server.CatPubSub},
+        []string{"user_?", "item_[ab]"}))
+    go s.ListenTCP()
+    defer s.Stop()
+    waitStarted(t, s)
+
+    c := server.NewClient(sAddr)
+    assert.Nil(t, c.Auth("", "secret"))
+    _, err := c.Call("OPT flush")
+    assert.Nil(t, err)
+    for _, key := range []string{"user_1", "user_22", "item_a", "item_c", "admin_1"} {
+        _, err = c.Call(_s("SET %s val 0", key))
+        assert.Nil(t, err)
+    }
+
+    // Wider globs return only allowed keys
+    l := server.NewClient(sAddr)
+    assert.Nil(t, l.Auth("limited", "pass"))
+    keys, err := l.Keys("user_*")
+    assert.Nil(t, err)
+    assert.Equal(t, []string{"user_1"}, keys)
+    keys, err = l.Keys("*")
+    assert.Nil(t, err)
+    assert.Equal(t, []string{"item_a", "user_1"}, keys)
+    _, keys, err = l.Scan(storage.ScanStart, "*", 100)
+    assert.Nil(t, err)
+    assert.Equal(t, []string{"item_a", "user_1"}, keys)
+    _, err = l.RandomKey()
+    assert.Equal(t, server.ErrNoPerm, err)
+
+    // Keyspace events of hidden keys are skipped
+    es, err := l.SubscribeKeys("user_*", storage.EventSet)
+    assert.Nil(t, err)
+    defer es.Close()
+    _, err = c.Call("SET user_33 val 0")
+    assert.Nil(t, err)
+    _, err = c.Call("SET user_3 val 0")
+    assert.Nil(t, err)
+    select {
+    case e := <-es.C:
+        assert.Equal(t, storage.Event{Type: storage.EventSet, Key: "user_3"}, e)
+    case <-time.After(time.Second):
+        t.Errorf("Event of user_3 not received")
+    }
+
+    // DELPREFIX deletes only allowed keys
+    n, err := l.DeleteByPrefix("user_")
+    assert.Nil(t, err)
+    assert.Equal(t, 2, n)
+    keys, err = c.Keys("user_*")
+    assert.Nil(t, err)
+    assert.Equal(t, []string{"user_22", "user_33"}, keys)
+}
+
+func TestHashPassword(t *testing.T) {
+    h := server.HashPassword("secret")
+    assert.True(t, server.CheckPassword(h, "secret"))
+    assert.False(t, server.CheckPassword(h, "Secret"))
+    assert.NotEqual(t, h, server.HashPassword("secret")) // Salted
+    assert.True(t, strings.HasPrefix(h, _s("pbkdf2-sha256$%d$", server.PasswordIterations)))
+
+    // Hash keeps its iteration count
+    defer func(n int) { server.PasswordIterations = n }(server.PasswordIterations)
+    server.PasswordIterations = 2000
+    h2 := server.HashPassword("secret")
+    assert.True(t, strings.HasPrefix(h2, "pbkdf2-sha256$2000$"))
+    assert.True(t, server.CheckPassword(h2, "secret"))
+    assert.True(t, server.CheckPassword(h, "secret"))
+    assert.False(t, server.CheckPassword("sha256$salt$hash", "secret"))
+    assert.False(t, server.CheckPassword(strings.Replace(h2, "$2000$", "$2001$", 1), "secret"))
+}
+
+// testCert generates ECDSA certificate signed by parent (self-signed if
+// parent is nil) and writes it with key to dir as name.crt and name.key
+func testCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    assert.Nil(t, err)
+    tpl := &x509.Certificate{
+        SerialNumber: big.NewInt(time.Now().UnixNano()),
+        Subject: pkix.Name{CommonName: name},
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: time.Now().Add(time.Hour),
+        IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+        ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+    }
+    if parent == nil {
+        tpl.IsCA = true
+        tpl.BasicConstraintsValid = true
+        tpl.KeyUsage = x509.KeyUsageCertSign
+        parent, parentKey = tpl, key
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tpl, parent, &key.PublicKey, parentKey)
+    assert.Nil(t, err)
+    cert, err := x509.ParseCertificate(der)
+    assert.Nil(t, err)
+    keyDer, err := x509.MarshalECPrivateKey(key)
+    assert.Nil(t, err)
+    ioutil.WriteFile(filepath.Join(dir, name + ".crt"),
+        pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+    ioutil.WriteFile(filepath.Join(dir, name + ".key"),
+        pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+    return cert, key
+}
+
+func TestTLS(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "gache_tls")
+    defer os.RemoveAll(dir)
+    ca, caKey := testCert(t, dir, "ca", nil, nil)
+    testCert(t, dir, "server", ca, caKey)
+    testCert(t, dir, "client", ca, caKey)
+    f := func(name string) string { return filepath.Join(dir, name) }
+
+    sAddr := "127.0.0.1:8825"
+    s := server.NewServer(sAddr)
+    cfg, err := server.ServerTLSConfig(f("server.crt"), f("server.key"), "")
+    assert.Nil(t, err)
+    s.TLSConfig = cfg
+    go s.ListenTCP()
+    defer s.Stop()
+
+    // Mutual TLS
+    mAddr := "127.0.0.1:8826"
+    m := server.NewServer(mAddr)
+    m.KeepAlive = true
+    cfg, err = server.ServerTLSConfig(f("server.crt"), f("server.key"), f("ca.crt"))
+    assert.Nil(t, err)
+    m.TLSConfig = cfg
+    go m.ListenTCP()
+    defer m.Stop()
+    waitStarted(t, m)
+
+    c := server.NewClient(sAddr)
+    c.TLSConfig, err = server.ClientTLSConfig(f("ca.crt"), "", "")
+    assert.Nil(t, err)
+    res, err := c.Send("PING")
+    assert.Nil(t, err)
+    assert.Equal(t, "PONG", res)
+
+    // Server certificate isn't trusted without CA
+    c = server.NewClient(sAddr)
+    c.TLSConfig, _ = server.ClientTLSConfig("", "", "")
+    _, err = c.Send("PING")
+    assert.NotNil(t, err)
+
+    // Plain client can't talk to TLS server
+    res, _ = server.NewClient(sAddr).Send("PING")
+    assert.NotEqual(t, "PONG", res)
+
+    // Client certificate required by mutual TLS
+    c = server.NewClient(mAddr)
+    c.TLSConfig, _ = server.ClientTLSConfig(f("ca.crt"), "", "")
+    _, err = c.Send("PING")
+    assert.NotNil(t, err)
+
+    c = server.NewClient(mAddr)
+    c.KeepAlive = true
+    defer c.Close()
+    c.TLSConfig, err = server.ClientTLSConfig(f("ca.crt"), f("client.crt"), f("client.key"))
+    assert.Nil(t, err)
+    for i := 0; i < 2; i++ {
+        res, err = c.Send("PING")
+        assert.Nil(t, err)
+        assert.Equal(t, "PONG", res)
+    }
+}
+
+func TestTLSReject(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "gache_tls")
+    defer os.RemoveAll(dir)
+    ca, caKey := testCert(t, dir, "ca", nil, nil)
+    testCert(t, dir, "server", ca, caKey)
+    f := func(name string) string { return filepath.Join(dir, name) }
+
+    sAddr := "127.0.0.1:8831"
+    server.MaxRejects = 1
+    s := server.NewServer(sAddr)
+    server.MaxRejects = 64
+    s.KeepAlive = true
+    s.MaxConns = 1
+    s.TLSConfig, _ = server.ServerTLSConfig(f("server.crt"), f("server.key"), "")
+    go s.ListenTCP()
+    defer s.Stop()
+    waitStarted(t, s)
+    clientCfg, _ := server.ClientTLSConfig(f("ca.crt"), "", "")
+
+    c := server.NewClient(sAddr)
+    c.KeepAlive = true
+    c.TLSConfig = clientCfg
+    res, err := c.Send("PING")
+    assert.Nil(t, err)
+    assert.Equal(t, "PONG", res)
+
+    // Rejected client never starts handshake
+    silent, err := net.Dial("tcp", sAddr)
+    assert.Nil(t, err)
+    defer silent.Close()
+    waitFor(t, func() bool { return s.Counters().RejectedConns == 1 }, "Connection not rejected")
+
+    // Reply to silent client in progress, so next one closed at once
+    flood, err := net.Dial("tcp", sAddr)
+    assert.Nil(t, err)
+    defer flood.Close()
+    flood.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+    n, err := flood.Read(make([]byte, 1))
+    assert.Equal(t, 0, n)
+    assert.Equal(t, io.EOF, err)
+    c.Close()
+    waitFor(t, func() bool { return s.Info().Clients == 0 }, "Connection not closed")
+
+    done := make(chan string, 1)
+    go func() {
+        c := server.NewClient(sAddr)
+        c.TLSConfig = clientCfg
+        res, _ := c.Send("PING")
+        done <- res
+    }()
+    select {
+    case res = <-done:
+        assert.Equal(t, "PONG", res)
+    case <-time.After(2 * time.Second):
+        t.Errorf("Accept blocked by rejected connection")
+    }
+}
+
+func TestUnixSocket(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "gache_unix")
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "gache.sock")
+
+    // Socket left by crashed server
+    ln, err := net.Listen("unix", path)
+    assert.Nil(t, err)
+    ln.(*net.UnixListener).SetUnlinkOnClose(false)
+    ln.Close()
+
+    sAddr := server.UnixPrefix + path
+    s := server.NewServer(sAddr)
+    s.KeepAlive = true
+    s.SocketPerm = 0600
+    errs := make(chan error, 1)
+    go func() { errs <- s.ListenTCP() }()
+    waitStarted(t, s)
+
+    fi, err := os.Stat(path)
+    assert.Nil(t, err)
+    assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+    // Running server's socket isn't removed
+    assert.Equal(t, server.ErrSocketInUse, server.NewServer(sAddr).ListenTCP())
+
+    c := server.NewClient(sAddr)
+    res, err := c.Send("PING")
+    assert.Nil(t, err)
+    assert.Equal(t, "PONG", res)
+    c.KeepAlive = true
+    for i := 0; i < 2; i++ {
+        res, _ = c.Send("PING")
+        assert.Equal(t, "PONG", res)
+    }
+    c.Close()
+
+    s.Stop()
+    assert.Equal(t, server.ErrServerClosed, <-errs)
+    _, err = os.Stat(path)
+    assert.True(t, os.IsNotExist(err))
+}
+
+func TestINFO(t *testing.T) {
+    cln.Send("OPT flushall")
+    cln.Send("SET info_1 val 100")
+    cln.Send("GET info_1")
+    info, err := cln.Info()
+    assert.Nil(t, err)
+    assert.Equal(t, "1", info["keys"])
+    assert.Equal(t, "1", info["expires"])
+    assert.Equal(t, "1", info["db0"])
+    assert.NotEqual(t, "", info["mem_alloc"])
+    assert.NotEqual(t, "0", info["goroutines"])
+    assert.NotEqual(t, "", info["cmd_SET"])
+    assert.NotEqual(t, "0", info["hits"])
+    assert.NotEqual(t, "0", info["used_memory"])
+    assert.Equal(t, "0.00", info["compression_ratio"])
+}
+
+func TestMetrics(t *testing.T) {
+    cln.Send("SET metrics_1 val 0")
+    cln.Send("GET metrics_1")
+    cln.Send("GET metrics_unknown")
+
+    w := httptest.NewRecorder()
+    srv.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+    body := w.Body.String()
+    assert.Equal(t, 200, w.Code)
+    assert.Contains(t, body, "# TYPE gache_command_duration_seconds histogram")
+    assert.Contains(t, body, `gache_command_duration_seconds_bucket{cmd="GET",le="+Inf"}`)
+    assert.Contains(t, body, `gache_command_duration_seconds_count{cmd="SET"}`)
+    assert.Contains(t, body, `gache_errors_total{code="400"}`)
+    assert.Contains(t, body, `gache_keys{db="0"}`)
+    assert.Contains(t, body, "gache_connections_total")
+    assert.Contains(t, body, "gache_expired_keys_total")
+    assert.NotContains(t, body, `gache_command_duration_seconds_count{cmd="GET"} 0`)
+}
+
+func TestSLOWLOG(t *testing.T) {
+    sAddr := "127.0.0.1:8827"
+    s := server.NewServer(sAddr)
+    s.KeepAlive = true
+    s.SlowLogThreshold = time.Nanosecond // Every command is slow
+    s.SlowLogMax = 2
+    go s.ListenTCP()
+    defer s.Stop()
+    waitStarted(t, s)
+
+    c := server.NewClient(sAddr)
+    c.KeepAlive = true
+    defer c.Close()
+    c.Send("GET slow_1")
+    c.Send("GET slow_2")
+    c.Send("GET slow_3")
+
+    // SLOWLOG itself logged after it returns
+    entries, err := c.SlowLog(0)
+    assert.Nil(t, err)
+    assert.Equal(t, 2, len(entries))
+    assert.Equal(t, "slow_3", entries[0].Key)
+    assert.Equal(t, "GET", entries[0].Cmd)
+    assert.Equal(t, int64(3), entries[0].ID)
+    assert.Equal(t, "slow_2", entries[1].Key)
+    assert.NotEqual(t, "", entries[0].Addr)
+
+    entries, _ = c.SlowLog(1)
+    assert.Equal(t, 1, len(entries))
+    assert.Equal(t, server.CMD_SLOWLOG, entries[0].Cmd)
+
+    assert.Nil(t, c.SlowLogReset())
+    n, err := c.SlowLogLen()
+    assert.Nil(t, err)
+    assert.Equal(t, 1, n) // RESET itself
+
+    // Order kept when max grows after ring wrapped
+    c.Send("GET slow_4") // Overwrites RESET
+    st := s.Settings()
+    st.SlowLogMax = 4
+    s.Reload(st)
+    c.Send("GET slow_5")
+    entries, _ = c.SlowLog(0)
+    assert.Equal(t, 3, len(entries))
+    assert.Equal(t, "slow_5", entries[0].Key)
+    assert.Equal(t, "slow_4", entries[1].Key)
+    assert.Equal(t, server.CMD_SLOWLOG, entries[2].Cmd)
+}
+
+func TestReload(t *testing.T) {
+    sAddr := "127.0.0.1:8828"
+    s := server.NewServer(sAddr)
+    s.KeepAlive = true
+    s.MaxConns = 1
+    go s.ListenTCP()
+    defer s.Stop()
+    waitStarted(t, s)
+
+    c1 := server.NewClient(sAddr)
+    c1.KeepAlive = true
+    defer c1.Close()
+    res, _ := c1.Send("PING")
+    assert.Equal(t, "PONG", res)
+    res, _ = server.NewClient(sAddr).Send("PING")
+    assert.Equal(t, "[503] Too many connections", res)
+
+    // New limit and ACL applied to new connections
+    st := s.Settings()
+    assert.Equal(t, 1, st.MaxConns)
+    st.MaxConns = 2
+    st.ACL = server.NewACL()
+    st.ACL.AddUser(server.NewDefaultUser("secret"))
+    s.Reload(st)
+    res, _ = server.NewClient(sAddr).Send("PING")
+    assert.Equal(t, "[401] Authentication required", res)
+    res, _ = c1.Send("PING")
+    assert.Equal(t, "PONG", res)
+    assert.Equal(t, 1, s.MaxConns) // Fields aren't changed
+}
+
+func TestServerOptions(t *testing.T) {
+    own := storage.NewStorage()
+    defer own.Close()
+    s1 := server.NewServer("127.0.0.1:8829", server.WithStorage(own),
+        server.WithKeepAlive(true))
+    s2 := server.NewServer("127.0.0.1:8830", server.WithDatabases(2,
+        storage.WithMaxMemory(200)), server.WithSettings(server.Settings{MaxConns: 1}))
+    go s1.ListenTCP()
+    go s2.ListenTCP()
+    defer s1.Stop()
+    waitStarted(t, s1)
+    waitStarted(t, s2)
+
+    // Each server uses own storage
+    c1 := server.NewClient("127.0.0.1:8829")
+    c1.KeepAlive = true
+    defer c1.Close()
+    res, _ := c1.Send("SET opt_key opt_1 0")
+    assert.Equal(t, "[201]", res)
+    v, _ := own.Get("opt_key")
+    assert.Equal(t, "opt_1", v)
+    assert.Equal(t, 1, len(s1.Databases()))
+    res, _ = c1.Send("SELECT 1")
+    assert.Equal(t, "[400] Bad database", res)
+
+    c2 := server.NewClient("127.0.0.1:8830")
+    res, _ = c2.Send("GET opt_key")
+    assert.Equal(t, "[400] Key not found", res)
+    res, _ = server.NewClient("127.0.0.1:8830").Send("SET opt_big " + strings.Repeat("v", 200) + " 0")
+    assert.Equal(t, "[201]", res)
+    res, _ = server.NewClient("127.0.0.1:8830").Send("SET opt_key v 0")
+    assert.Equal(t, "[400] Out of memory", res)
+    assert.Equal(t, 1, s2.Settings().MaxConns)
+    assert.Equal(t, 2, len(s2.Databases()))
+
+    // Own databases closed on shutdown
+    s2.Stop()
+    _, err := s2.Databases()[0].Get("opt_key")
+    assert.Equal(t, storage.ErrClosed, err)
+}
+
+type typedPoint struct {
+    X, Y int
+}
+
+func TestTypedClient(t *testing.T) {
+    codec := storage.JSONCodec[typedPoint]{}
+    tc := server.NewTypedClient[typedPoint](kaCln, codec)
+    assert.Nil(t, tc.Set("typed_p1", typedPoint{1, 2}, 0))
+    assert.Equal(t, storage.ErrAlreadyExists, tc.Set("typed_p1", typedPoint{}, 0))
+    p, err := tc.Get("typed_p1")
+    assert.Nil(t, err)
+    assert.Equal(t, typedPoint{1, 2}, p)
+
+    // Values cross TCP boundary encoded by the same codec
+    p, err = storage.NewTyped[typedPoint](server.Store(), codec).Get("typed_p1")
+    assert.Nil(t, err)
+    assert.Equal(t, typedPoint{1, 2}, p)
+    assert.Nil(t, storage.NewTyped[typedPoint](server.Store(), codec).Set("typed_p2", typedPoint{3, 4}, 0))
+    p, err = tc.Get("typed_p2")
+    assert.Nil(t, err)
+    assert.Equal(t, typedPoint{3, 4}, p)
+
+    assert.Nil(t, tc.Update("typed_p2", typedPoint{5, 6}, 0))
+    p, _ = tc.Get("typed_p2")
+    assert.Equal(t, typedPoint{5, 6}, p)
+    assert.Nil(t, tc.Delete("typed_p1"))
+    _, err = tc.Get("typed_p1")
+    assert.Equal(t, storage.ErrNotFound, err)
+
+    // Without codec only strings are sent as is
+    sc := server.NewTypedClient[string](kaCln, nil)
+    assert.Nil(t, sc.Set("typed_s1", "plain", 0))
+    str, err := sc.Get("typed_s1")
+    assert.Nil(t, err)
+    assert.Equal(t, "plain", str)
+    ic := server.NewTypedClient[int](kaCln, nil)
+    assert.Equal(t, storage.ErrBadType, ic.Set("typed_i1", 1, 0))
+    _, err = ic.Get("typed_s1")
+    assert.Equal(t, storage.ErrBadType, err)
+}
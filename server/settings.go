@@ -0,0 +1,62 @@
+package server
+
+import (
+	"time"
+)
+
+// Settings are Server settings which can be changed by Reload while server
+// is running. Field meaning is the same as of Server fields
+type Settings struct {
+	IdleTimeout time.Duration
+	ReadTimeout time.Duration
+	WriteTimeout time.Duration
+	MaxLineLength int
+	MaxConns int
+	MaxConnsPerIP int
+	RateLimit float64
+	RateBurst int
+	RateLimitBy string
+	SlowLogThreshold time.Duration
+	SlowLogMax int
+	ACL *ACL // Applied to new connections
+}
+
+// Settings returns current settings. Before server started they are taken
+// from Server fields
+func (s *Server) Settings() Settings {
+	return *s.settings()
+}
+
+// Reload replaces settings of running server. Connections in progress get
+// new timeouts and limits with next command, rate limit and ACL applied
+// to new connections only
+func (s *Server) Reload(st Settings) {
+	s.current.Store(&st)
+	s.log.Infow("Settings reloaded", "addr", s.addr)
+}
+
+// settings returns snapshot of current settings
+func (s *Server) settings() *Settings {
+	if st, ok := s.current.Load().(*Settings); ok {
+		return st
+	}
+	return s.fieldSettings()
+}
+
+// fieldSettings makes Settings from Server fields
+func (s *Server) fieldSettings() *Settings {
+	return &Settings{
+		IdleTimeout: s.IdleTimeout,
+		ReadTimeout: s.ReadTimeout,
+		WriteTimeout: s.WriteTimeout,
+		MaxLineLength: s.MaxLineLength,
+		MaxConns: s.MaxConns,
+		MaxConnsPerIP: s.MaxConnsPerIP,
+		RateLimit: s.RateLimit,
+		RateBurst: s.RateBurst,
+		RateLimitBy: s.RateLimitBy,
+		SlowLogThreshold: s.SlowLogThreshold,
+		SlowLogMax: s.SlowLogMax,
+		ACL: s.ACL,
+	}
+}
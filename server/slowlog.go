@@ -0,0 +1,122 @@
+package server
+
+import (
+	"sync"
+	"time"
+	"strings"
+	"strconv"
+)
+
+// DefaultSlowLogMax is default number of entries kept in slow log
+const DefaultSlowLogMax = 128
+
+// SlowLogEntry describes one command executed longer than
+// Server.SlowLogThreshold
+type SlowLogEntry struct {
+	ID       int64
+	Time     time.Time
+	Duration time.Duration
+	Addr     string // Client address
+	Cmd      string
+	Key      string
+}
+
+// String returns entry as comma separated "id,unix_time,usec,addr,cmd,key"
+func (e *SlowLogEntry) String() string {
+	return _s("%d,%d,%d,%s,%s,%s", e.ID, e.Time.Unix(),
+		int64(e.Duration / time.Microsecond), e.Addr, e.Cmd, e.Key)
+}
+
+// parseSlowLogEntry is reverse of SlowLogEntry.String
+func parseSlowLogEntry(s string) (*SlowLogEntry, error) {
+	f := strings.SplitN(s, ",", 6)
+	if len(f) != 6 {
+		return nil, ErrBadRequest
+	}
+	e := &SlowLogEntry{Addr: f[3], Cmd: f[4], Key: f[5]}
+	var err error
+	var stamp, usec int64
+	if e.ID, err = strconv.ParseInt(f[0], 10, 64); err != nil {
+		return nil, err
+	}
+	if stamp, err = strconv.ParseInt(f[1], 10, 64); err != nil {
+		return nil, err
+	}
+	if usec, err = strconv.ParseInt(f[2], 10, 64); err != nil {
+		return nil, err
+	}
+	e.Time = time.Unix(stamp, 0)
+	e.Duration = time.Duration(usec) * time.Microsecond
+	return e, nil
+}
+
+// slowLog is ring of last slow commands
+type slowLog struct {
+	lock    sync.Mutex
+	entries []*SlowLogEntry
+	next    int // Position for next entry
+	lastID  int64
+}
+
+// add saves entry, overwriting oldest one if ring has max entries
+func (l *slowLog) add(e *SlowLogEntry, max int) {
+	if max < 1 {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.lastID++
+	e.ID = l.lastID
+	if len(l.entries) > max { // Max decreased
+		l.entries, l.next = l.newest(max), 0
+	}
+	if len(l.entries) < max {
+		if l.next != len(l.entries) { // Ring wrapped before max increased
+			l.entries, l.next = l.newest(len(l.entries)), 0
+		}
+		l.entries = append(l.entries, e)
+		l.next = len(l.entries) % max
+		return
+	}
+	l.entries[l.next] = e
+	l.next = (l.next + 1) % max
+}
+
+// Get returns up to n newest entries, newest first. Non-positive n
+// returns all of them
+func (l *slowLog) Get(n int) []*SlowLogEntry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if n < 1 || n > len(l.entries) {
+		n = len(l.entries)
+	}
+	ordered := l.newest(n)
+	res := make([]*SlowLogEntry, len(ordered))
+	for i, e := range ordered {
+		res[len(ordered)-1-i] = e
+	}
+	return res
+}
+
+// newest returns n newest entries, oldest first
+func (l *slowLog) newest(n int) []*SlowLogEntry {
+	ordered := append(append([]*SlowLogEntry{}, l.entries[l.next:]...), l.entries[:l.next]...)
+	if n < len(ordered) {
+		ordered = ordered[len(ordered)-n:]
+	}
+	return ordered
+}
+
+// Len returns number of entries
+func (l *slowLog) Len() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return len(l.entries)
+}
+
+// Reset removes all entries
+func (l *slowLog) Reset() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.entries, l.next = nil, 0
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"strings"
+	st "github.com/avsolo/gache/storage"
+)
+
+// TypedClient is type safe wrapper of Client for values of type V. Values
+// are sent encoded by codec, so they can be read by storage.Typed with the
+// same codec on server side and vice versa
+type TypedClient[V any] struct {
+	c     *Client
+	codec st.Codec[V]
+}
+
+// NewTypedClient wraps c. Codec can be nil, then values are sent as is,
+// so only strings can be sent and read, other types get ErrBadType
+func NewTypedClient[V any](c *Client, codec st.Codec[V]) *TypedClient[V] {
+	return &TypedClient[V]{c: c, codec: codec}
+}
+
+// Client returns wrapped Client
+func (t *TypedClient[V]) Client() *Client {
+	return t.c
+}
+
+// Get returns value of key
+func (t *TypedClient[V]) Get(key string) (V, error) {
+	res, err := t.c.Call("%s %s", CMD_GET, key)
+	if err != nil {
+		var zero V
+		return zero, err
+	}
+	return t.decode(res)
+}
+
+// Set sets value of key. Like Storage.Set it doesn't overwrite existing key
+func (t *TypedClient[V]) Set(key string, v V, ttl int) error {
+	return t.send(CMD_SET, key, v, ttl)
+}
+
+// Update updates value of existing key
+func (t *TypedClient[V]) Update(key string, v V, ttl int) error {
+	return t.send(CMD_UPD, key, v, ttl)
+}
+
+// Delete deletes key
+func (t *TypedClient[V]) Delete(key string) error {
+	_, err := t.c.Call("%s %s", CMD_DEL, key)
+	return err
+}
+
+func (t *TypedClient[V]) send(cmd, key string, v V, ttl int) error {
+	s, err := t.encode(v)
+	if err != nil {
+		return err
+	}
+	if strings.ContainsAny(s, "\r\n") {
+		return ErrBadValue
+	}
+	_, err = t.c.Call("%s %s %s %d", cmd, key, s, ttl)
+	return err
+}
+
+// encode returns value sent to server
+func (t *TypedClient[V]) encode(v V) (string, error) {
+	if t.codec != nil {
+		return t.codec.Encode(v)
+	}
+	if s, ok := any(v).(string); ok {
+		return s, nil
+	}
+	return "", st.ErrBadType
+}
+
+// decode converts value received from server to V
+func (t *TypedClient[V]) decode(s string) (V, error) {
+	if t.codec != nil {
+		return t.codec.Decode(s)
+	}
+	if v, ok := any(s).(V); ok {
+		return v, nil
+	}
+	var zero V
+	return zero, st.ErrBadType
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"os"
+	"net"
+	"strings"
+)
+
+// UnixPrefix marks address of Unix domain socket, e.g. unix:///tmp/gache.sock
+const UnixPrefix = "unix://"
+
+// DefaultSocketPerm is default permissions of Unix socket file
+const DefaultSocketPerm os.FileMode = 0660
+
+// parseAddr returns network and address for net.Listen and net.Dial
+func parseAddr(addr string) (string, string) {
+	if strings.HasPrefix(addr, UnixPrefix) {
+		return "unix", strings.TrimPrefix(addr, UnixPrefix)
+	}
+	return "tcp", addr
+}
+
+// listenUnix listens Unix socket at path with permissions perm. Socket
+// file left by crashed server is removed, but socket used by running
+// server isn't touched and ErrSocketInUse returned
+func listenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, perm); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// removeStaleSocket removes socket file if nobody listens it
+func removeStaleSocket(path string) error {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode() & os.ModeSocket == 0 {
+		return ErrNotSocket
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return ErrSocketInUse
+	}
+	log.Warnw("Removing stale socket", "path", path)
+	return os.Remove(path)
+}
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is source of current time used by Storage for TTL and expire
+// tracking
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks of Clock like time.Ticker
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// SystemClock is Clock returning time.Now
+type SystemClock struct{}
+
+// Now implements Clock
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTicker implements Clock with time.Ticker
+func (SystemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	t *time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time { return t.t.C }
+func (t systemTicker) Stop() { t.t.Stop() }
+
+// FakeClock is Clock for tests. Its time changes only by Advance and Set,
+// tickers fire when time passes their next tick. Storage with FakeClock
+// treats keys as expired as soon as time advanced, without waiting for
+// expire tracking
+type FakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	tickers map[*fakeTicker]struct{}
+}
+
+// NewFakeClock creates FakeClock showing t
+func NewFakeClock(t time.Time) *FakeClock {
+	return &FakeClock{now: t, tickers: map[*fakeTicker]struct{}{}}
+}
+
+// Now implements Clock
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// NewTicker implements Clock
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t := &fakeTicker{clock: c, c: make(chan time.Time, 1), d: d, next: c.now.Add(d)}
+	c.tickers[t] = struct{}{}
+	return t
+}
+
+// Advance moves time forward by d
+func (c *FakeClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// Set changes time to t. Tickers which next tick passed fire once, like
+// time.Ticker dropping ticks for slow receivers
+func (c *FakeClock) Set(t time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = t
+	for tk := range c.tickers {
+		if t.Before(tk.next) {
+			continue
+		}
+		select {
+		case tk.c <- t:
+		default:
+		}
+		tk.next = tk.next.Add((t.Sub(tk.next) / tk.d + 1) * tk.d)
+	}
+}
+
+type fakeTicker struct {
+	clock *FakeClock
+	c     chan time.Time
+	d     time.Duration
+	next  time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.c }
+
+func (t *fakeTicker) Stop() {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	delete(t.clock.tickers, t)
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"strconv"
+	"encoding/json"
+)
+
+// Codec converts values of type V to strings and back. Typed stores values
+// encoded by codec, so they can be read and written over TCP as plain
+// strings. Encoded value must be one line
+type Codec[V any] interface {
+	Encode(v V) (string, error)
+	Decode(s string) (V, error)
+}
+
+// JSONCodec encodes values as compact JSON
+type JSONCodec[V any] struct{}
+
+// Encode implements Codec
+func (JSONCodec[V]) Encode(v V) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+// Decode implements Codec
+func (JSONCodec[V]) Decode(s string) (V, error) {
+	var v V
+	err := json.Unmarshal([]byte(s), &v)
+	return v, err
+}
+
+// StringCodec keeps strings as is
+type StringCodec struct{}
+
+// Encode implements Codec
+func (StringCodec) Encode(v string) (string, error) { return v, nil }
+
+// Decode implements Codec
+func (StringCodec) Decode(s string) (string, error) { return s, nil }
+
+// IntCodec encodes ints as decimal numbers
+type IntCodec struct{}
+
+// Encode implements Codec
+func (IntCodec) Encode(v int) (string, error) { return strconv.Itoa(v), nil }
+
+// Decode implements Codec
+func (IntCodec) Decode(s string) (int, error) { return strconv.Atoi(s) }
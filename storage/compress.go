@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"bytes"
+	"sync/atomic"
+	"compress/flate"
+)
+
+// compressed is string or []byte value stored compressed, see
+// WithCompression. Item.Value returns it decompressed
+type compressed struct {
+	data  []byte
+	size  int  // Length of original value
+	bytes bool // Original value is []byte
+}
+
+// SetCompression enables compression of string and []byte values not
+// shorter than threshold bytes. Non-positive threshold disables it. Only
+// values written after call are affected
+func (s *Storage) SetCompression(threshold int) {
+	atomic.StoreInt64(&s.compressMin, int64(threshold))
+}
+
+// compress returns val compressed if compression enabled, val is long
+// enough string or []byte and compression makes it smaller. It's called
+// before Storage lock taken, so long compression doesn't block other calls
+func (s *Storage) compress(val interface{}) interface{} {
+	min := atomic.LoadInt64(&s.compressMin)
+	if min < 1 {
+		return val
+	}
+	var raw []byte
+	isBytes := false
+	switch t := val.(type) {
+	case string:
+		raw = []byte(t)
+	case []byte:
+		raw, isBytes = t, true
+	default:
+		return val
+	}
+	if int64(len(raw)) < min {
+		return val
+	}
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed) // Level is valid
+	w.Write(raw)
+	w.Close()
+	if buf.Len() >= len(raw) {
+		return val
+	}
+	return &compressed{data: buf.Bytes(), size: len(raw), bytes: isBytes}
+}
+
+// value returns decompressed value
+func (c *compressed) value() interface{} {
+	buf := bytes.NewBuffer(make([]byte, 0, c.size))
+	if _, err := buf.ReadFrom(flate.NewReader(bytes.NewReader(c.data))); err != nil {
+		return nil // Data compressed by Storage itself can't be broken
+	}
+	if c.bytes {
+		return buf.Bytes()
+	}
+	return buf.String()
+}
+
+// countCompressedUnsafe adds (n is 1) or removes (n is -1) item value to
+// compression stats
+func (s *Storage) countCompressedUnsafe(el ItemInterface, n int64) {
+	if c, ok := rawValue(el).(*compressed); ok {
+		s.compressed.keys += n
+		s.compressed.size += n * int64(len(c.data))
+		s.compressed.original += n * int64(c.size)
+	}
+}
+
+// rawValue returns item value as stored, without decompression
+func rawValue(el ItemInterface) interface{} {
+	if it, ok := el.(*Item); ok {
+		return it.value
+	}
+	return el.Value()
+}
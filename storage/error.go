@@ -5,10 +5,12 @@ import (
 	"github.com/avsolo/gache/lib"
 )
 
-var log *lib.Logger
+var log lib.LoggerInterface = lib.NewLogger("storage")
 
-func init() {
-	log = lib.NewLogger("storage")
+// SetLogger replaces logger of storage package. It must be called before
+// any Storage created, see also WithLogger
+func SetLogger(l lib.LoggerInterface) {
+	log = l
 }
 
 // ErrAlreadyExists uses when client trying to set existing key
@@ -31,3 +33,29 @@ var ErrNoExpire = errors.New("Key has no expire")
 var ErrBadMap = errors.New("Bad argument(s) for hash")
 
 var ErrNotDict = errors.New("Key not dict")
+
+// ErrClosed returns by any call to closed Storage
+var ErrClosed = errors.New("Storage closed")
+
+// ErrBadPattern returns when key pattern has wrong syntax
+var ErrBadPattern = errors.New("Bad pattern")
+
+// ErrBadEvent returns when subscribing to unknown event type
+var ErrBadEvent = errors.New("Bad event")
+
+// ErrBadCursor returns when Scan cursor is wrong
+var ErrBadCursor = errors.New("Bad cursor")
+
+// ErrOutOfMemory returns by writes when MaxMemory reached and eviction
+// policy is EvictNone
+var ErrOutOfMemory = errors.New("Out of memory")
+
+// ErrBadPolicy returns when eviction policy is unknown
+var ErrBadPolicy = errors.New("Bad eviction policy")
+
+// ErrBadType returns by Typed when key holds value of other type
+var ErrBadType = errors.New("Bad value type")
+
+// ErrLoaderPanic returns by GetOrLoad to callers waiting for loader which
+// panicked
+var ErrLoaderPanic = errors.New("Loader panicked")
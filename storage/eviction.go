@@ -0,0 +1,151 @@
+package storage
+
+import "sync/atomic"
+
+// EvictionPolicy selects keys deleted when Storage reaches MaxMemory
+type EvictionPolicy string
+
+const (
+	// EvictNone rejects writes with ErrOutOfMemory
+	EvictNone EvictionPolicy = "noeviction"
+	// EvictAllKeysLRU deletes least recently used keys
+	EvictAllKeysLRU EvictionPolicy = "allkeys-lru"
+	// EvictAllKeysRandom deletes random keys
+	EvictAllKeysRandom EvictionPolicy = "allkeys-random"
+	// EvictVolatileLRU deletes least recently used keys with expire
+	EvictVolatileLRU EvictionPolicy = "volatile-lru"
+	// EvictVolatileTTL deletes keys with nearest expire
+	EvictVolatileTTL EvictionPolicy = "volatile-ttl"
+)
+
+// EvictionPolicies lists all known policies
+var EvictionPolicies = []EvictionPolicy{EvictNone, EvictAllKeysLRU,
+	EvictAllKeysRandom, EvictVolatileLRU, EvictVolatileTTL}
+
+// evictionSamples is number of keys checked by LRU policies to find least
+// recently used one. Like in Redis, LRU is approximated by sampling
+const evictionSamples = 5
+
+// ParseEvictionPolicy returns policy by name or ErrBadPolicy
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	for _, p := range EvictionPolicies {
+		if string(p) == name {
+			return p, nil
+		}
+	}
+	return EvictNone, ErrBadPolicy
+}
+
+// SetMaxMemory changes memory limit (0 - unlimited). Keys are evicted by
+// next write if usage is over new limit
+func (s *Storage) SetMaxMemory(n int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.maxMemory = n
+}
+
+// SetEvictionPolicy changes eviction policy
+func (s *Storage) SetEvictionPolicy(p EvictionPolicy) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.policy = p
+}
+
+// MemoryUsed returns estimated memory used by all keys in bytes
+func (s *Storage) MemoryUsed() int64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.used
+}
+
+// touch marks item as just used for LRU policies. It's safe under read lock
+func (s *Storage) touch(el ItemInterface) {
+	if it, ok := el.(*Item); ok {
+		atomic.StoreInt64(&it.access, atomic.AddInt64(&s.accessSeq, 1))
+	}
+}
+
+// lastAccess returns sequence number of last use of item
+func lastAccess(el ItemInterface) int64 {
+	if it, ok := el.(*Item); ok {
+		return atomic.LoadInt64(&it.access)
+	}
+	return 0
+}
+
+// reserveUnsafe checks that write is allowed. With EvictNone it returns
+// ErrOutOfMemory while usage is over limit
+func (s *Storage) reserveUnsafe() error {
+	if s.maxMemory > 0 && s.policy == EvictNone && s.used >= s.maxMemory {
+		return ErrOutOfMemory
+	}
+	return nil
+}
+
+// evictUnsafe deletes keys chosen by policy until usage fits limit. Key
+// just written isn't evicted
+func (s *Storage) evictUnsafe(keep string) {
+	for s.maxMemory > 0 && s.used > s.maxMemory {
+		key, found := s.victimUnsafe(keep)
+		if !found {
+			return
+		}
+		s.deleteUnsafe(key)
+		atomic.AddInt64(&s.counters.evicted, 1)
+		s.notify(EventEvicted, key, "")
+	}
+}
+
+// victimUnsafe returns key to evict by policy. Map iteration order is
+// random, so first keys of iteration are random sample
+func (s *Storage) victimUnsafe(keep string) (string, bool) {
+	victim, found, best := "", false, int64(0)
+	// consider makes key victim if its rank is lowest. Returns false for
+	// key which can't be evicted
+	consider := func(key string, rank int64) bool {
+		if key == keep {
+			return false
+		}
+		if !found || rank < best {
+			victim, found, best = key, true, rank
+		}
+		return true
+	}
+	samples := 0
+	switch s.policy {
+	case EvictAllKeysRandom:
+		for key := range s.data {
+			if consider(key, 0) {
+				break
+			}
+		}
+	case EvictAllKeysLRU:
+		for key, el := range s.data {
+			if consider(key, lastAccess(el)) {
+				if samples++; samples >= evictionSamples {
+					break
+				}
+			}
+		}
+	case EvictVolatileLRU:
+	loop:
+		for _, keys := range s.expire {
+			for key := range keys {
+				if consider(key, lastAccess(s.data[key])) {
+					if samples++; samples >= evictionSamples {
+						break loop
+					}
+				}
+			}
+		}
+	case EvictVolatileTTL:
+		for stamp, keys := range s.expire {
+			for key := range keys {
+				if consider(key, int64(stamp)) {
+					break // Any key of stamp
+				}
+			}
+		}
+	}
+	return victim, found
+}
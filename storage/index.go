@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"strings"
+)
+
+// prefixIndex is radix tree of keys, so keys starting with prefix are
+// found without scanning all keys. Root node has empty label
+type prefixIndex struct {
+	label string
+	leaf bool // Key ends at this node
+	children map[byte]*prefixIndex
+}
+
+func newPrefixIndex() *prefixIndex {
+	return &prefixIndex{children: map[byte]*prefixIndex{}}
+}
+
+// add inserts key to index
+func (n *prefixIndex) add(key string) {
+	for key != "" {
+		child, found := n.children[key[0]]
+		if !found {
+			n.children[key[0]] = &prefixIndex{label: key, leaf: true,
+				children: map[byte]*prefixIndex{}}
+			return
+		}
+		l := commonPrefix(child.label, key)
+		if l < len(child.label) { // Split child edge
+			mid := &prefixIndex{label: child.label[:l],
+				children: map[byte]*prefixIndex{child.label[l]: child}}
+			child.label = child.label[l:]
+			n.children[key[0]] = mid
+			child = mid
+		}
+		n, key = child, key[l:]
+	}
+	n.leaf = true
+}
+
+// remove deletes key from index. Returns false if key not found
+func (n *prefixIndex) remove(key string) bool {
+	if key == "" {
+		found := n.leaf
+		n.leaf = false
+		return found
+	}
+	child, found := n.children[key[0]]
+	if !found || !strings.HasPrefix(key, child.label) {
+		return false
+	}
+	if !child.remove(key[len(child.label):]) {
+		return false
+	}
+	if !child.leaf { // Drop empty node or merge it with single child
+		switch len(child.children) {
+		case 0:
+			delete(n.children, key[0])
+		case 1:
+			for _, gc := range child.children {
+				gc.label = child.label + gc.label
+				n.children[key[0]] = gc
+			}
+		}
+	}
+	return true
+}
+
+// keys returns all keys starting with prefix
+func (n *prefixIndex) keys(prefix string) []string {
+	path := ""
+	for prefix != "" {
+		child, found := n.children[prefix[0]]
+		if !found {
+			return nil
+		}
+		switch {
+		case strings.HasPrefix(prefix, child.label):
+			prefix = prefix[len(child.label):]
+		case strings.HasPrefix(child.label, prefix):
+			prefix = ""
+		default:
+			return nil
+		}
+		path += child.label
+		n = child
+	}
+	keys := []string{}
+	n.collect(path, &keys)
+	return keys
+}
+
+// collect appends keys of node subtree to keys. path is key of node
+func (n *prefixIndex) collect(path string, keys *[]string) {
+	if n.leaf {
+		*keys = append(*keys, path)
+	}
+	for _, child := range n.children {
+		child.collect(path + child.label, keys)
+	}
+}
+
+// commonPrefix returns length of common prefix of a and b
+func commonPrefix(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// indexUnsafe adds key and its tags to secondary indexes
+func (s *Storage) indexUnsafe(key string, el ItemInterface) {
+	s.prefixes.add(key)
+	for _, tag := range itemTags(el) {
+		s.addTagUnsafe(tag, key)
+	}
+}
+
+// unindexUnsafe removes key and its tags from secondary indexes
+func (s *Storage) unindexUnsafe(key string, el ItemInterface) {
+	s.prefixes.remove(key)
+	for _, tag := range itemTags(el) {
+		delete(s.tags[tag], key)
+		if len(s.tags[tag]) == 0 {
+			delete(s.tags, tag)
+		}
+	}
+}
+
+// resetIndexesUnsafe drops secondary indexes of all keys
+func (s *Storage) resetIndexesUnsafe() {
+	s.prefixes = newPrefixIndex()
+	s.tags = map[string]map[string]struct{}{}
+}
+
+func (s *Storage) addTagUnsafe(tag, key string) {
+	if _, found := s.tags[tag]; !found {
+		s.tags[tag] = map[string]struct{}{}
+	}
+	s.tags[tag][key] = struct{}{}
+}
+
+// itemTags returns tags of item
+func itemTags(el ItemInterface) []string {
+	if it, ok := el.(*Item); ok {
+		return it.tags
+	}
+	return nil
+}
@@ -1,5 +1,7 @@
 package storage
 
+// NoExpire marks Item which never expires. Any non-positive TTL passed to
+// Storage is converted to NoExpire
 const NoExpire = -1
 
 // Storage is core element, which consist data in map[string]interface{}
@@ -18,19 +20,32 @@ type Item struct {
 	key string
 	value interface{}
 	expire int
+	access int64 // Last use sequence number for LRU eviction
+	soft int // Stamp when value becomes stale, 0 - never
+	softTTL int // Soft and hard TTL set by SetSoft
+	hardTTL int
+	tags []string // Tags set by SetTagged
+	size int64 // Estimated memory used by key, value and tags
 }
 
 func NewItem(key string, val interface{}) ItemInterface {
-	return &Item{key: key, value: val}
+	return &Item{key: key, value: val, expire: NoExpire}
 }
 
 func (n *Item) Key() string { return n.key }
-func (n *Item) Value() interface{} { return n.value }
 func (n *Item) SetValue(v interface{}) { n.value = v }
 
+// Value returns item value. Value compressed by Storage is decompressed
+func (n *Item) Value() interface{} {
+	if c, ok := n.value.(*compressed); ok {
+		return c.value()
+	}
+	return n.value
+}
+
 func (n *Item) SetExpire(e int) {
 	if e < 1 {
-		n.expire = NoExpire
+		e = NoExpire
 	}
 	n.expire = e
 }
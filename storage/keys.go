@@ -0,0 +1,273 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+	"container/heap"
+	"encoding/hex"
+)
+
+// Types of values returned by Type
+const (
+	TypeString = "string"
+	TypeList   = "list"
+	TypeDict   = "dict"
+)
+
+// ScanStart is cursor to start Scan from. Scan returns it when iteration
+// finished
+const ScanStart = "0"
+
+// Keys returns sorted list of keys matched by glob pattern
+func (s *Storage) Keys(pattern string) ([]string, error) {
+	if _, err := MatchPattern(pattern, ""); err != nil {
+		return nil, err
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	keys := []string{}
+	now := s.now()
+	for key, el := range s.data {
+		if expired(el, now) {
+			continue
+		}
+		if ok, _ := MatchPattern(pattern, key); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Scan iterates keys matched by pattern in lexical order. First call must
+// use ScanStart cursor, next calls use returned cursor till ScanStart
+// returned again. Each call checks up to count keys. Keys existing during
+// whole iteration are returned exactly once, even if other keys were
+// added or deleted between calls.
+func (s *Storage) Scan(cursor, pattern string, count int) (string, []string, error) {
+	last, err := decodeCursor(cursor)
+	if err != nil {
+		return ScanStart, nil, err
+	}
+	if _, err := MatchPattern(pattern, ""); err != nil {
+		return ScanStart, nil, err
+	}
+	if count < 1 {
+		count = 10
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return ScanStart, nil, ErrClosed
+	}
+	started := cursor != ScanStart && cursor != ""
+	top := &keyHeap{} // count + 1 smallest keys after cursor
+	now := s.now()
+	for key, el := range s.data {
+		if expired(el, now) || (started && key <= last) {
+			continue
+		}
+		if top.Len() <= count {
+			heap.Push(top, key)
+		} else if key < (*top)[0] {
+			(*top)[0] = key
+			heap.Fix(top, 0)
+		}
+	}
+	next := make([]string, top.Len())
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i] = heap.Pop(top).(string)
+	}
+
+	more := len(next) > count
+	if more {
+		next = next[:count]
+	}
+	keys := []string{}
+	for _, key := range next {
+		if ok, _ := MatchPattern(pattern, key); ok {
+			keys = append(keys, key)
+		}
+	}
+	if !more {
+		return ScanStart, keys, nil
+	}
+	return hex.EncodeToString([]byte(next[count-1])), keys, nil
+}
+
+// keyHeap is max-heap of keys, so Scan keeps only smallest keys without
+// sorting all of them
+type keyHeap []string
+
+func (h keyHeap) Len() int            { return len(h) }
+func (h keyHeap) Less(i, j int) bool  { return h[i] > h[j] }
+func (h keyHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *keyHeap) Push(x interface{}) { *h = append(*h, x.(string)) }
+
+func (h *keyHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// decodeCursor returns last key returned by previous Scan call
+func decodeCursor(cursor string) (string, error) {
+	if cursor == ScanStart || cursor == "" {
+		return "", nil
+	}
+	last, err := hex.DecodeString(cursor)
+	if err != nil {
+		return "", ErrBadCursor
+	}
+	return string(last), nil
+}
+
+// Exists returns number of existing keys from passed
+func (s *Storage) Exists(keys ...string) int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	n := 0
+	for _, key := range keys {
+		if _, found := s.getUnsafe(key); found {
+			n++
+		}
+	}
+	return n
+}
+
+// Type returns type of value stored in key: TypeString, TypeList or
+// TypeDict. Any value which isn't list or dict treated as TypeString
+func (s *Storage) Type(key string) (string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return "", ErrClosed
+	}
+	el, found := s.getUnsafe(key)
+	if !found {
+		return "", ErrNotFound
+	}
+	return typeOf(rawValue(el)), nil
+}
+
+// typeOf returns type of value as Type does
+func typeOf(v interface{}) string {
+	switch v.(type) {
+	case ItemListInterface:
+		return TypeList
+	case map[string]interface{}:
+		return TypeDict
+	}
+	return TypeString
+}
+
+// Rename moves value, expire, tags and soft TTL from key to newKey. Like
+// Set it doesn't overwrite existing newKey and returns ErrAlreadyExists
+func (s *Storage) Rename(key, newKey string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	s.dropExpiredUnsafe(key)
+	s.dropExpiredUnsafe(newKey)
+	el, found := s.data[key]
+	if !found {
+		return ErrNotFound
+	}
+	if key == newKey {
+		return nil
+	}
+	if _, found := s.data[newKey]; found {
+		return ErrAlreadyExists
+	}
+	exp, _ := el.Expire()
+	s.deleteUnsafe(key)
+	it := NewItem(newKey, rawValue(el)).(*Item)
+	it.tags = itemTags(el)
+	if old, ok := el.(*Item); ok {
+		it.soft, it.softTTL, it.hardTTL = old.soft, old.softTTL, old.hardTTL
+	}
+	s.data[newKey] = it
+	s.indexUnsafe(newKey, s.data[newKey])
+	s.countCompressedUnsafe(s.data[newKey], 1)
+	s.resizeUnsafe(s.data[newKey], sizeOf(newKey, rawValue(el)) + tagsSize(itemTags(el)))
+	s.touch(s.data[newKey])
+	s.setExpireUnsafe(newKey, exp)
+	s.notify(EventDelete, key, "")
+	s.notify(EventSet, newKey, "")
+	return nil
+}
+
+// RandomKey returns random key or ErrEmpty if Storage has no keys
+func (s *Storage) RandomKey() (string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return "", ErrClosed
+	}
+	now := s.now()
+	for key, el := range s.data {
+		if !expired(el, now) {
+			return key, nil // Go map iteration order is random
+		}
+	}
+	return "", ErrEmpty
+}
+
+// moveLock serializes Move calls, so two Storage locks taken by Move can't
+// be taken in different order by another Move
+var moveLock sync.Mutex
+
+// Len returns number of keys in Storage. Expired keys are counted till
+// expire tracking deletes them
+func (s *Storage) Len() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.data)
+}
+
+// Move moves key with its value and expire to dst Storage. Existing key in
+// dst isn't overwritten and ErrAlreadyExists returned
+func (s *Storage) Move(key string, dst *Storage) error {
+	if s == dst {
+		return ErrAlreadyExists
+	}
+	moveLock.Lock()
+	defer moveLock.Unlock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	dst.lock.Lock()
+	defer dst.lock.Unlock()
+	if s.closed || dst.closed {
+		return ErrClosed
+	}
+	s.dropExpiredUnsafe(key)
+	dst.dropExpiredUnsafe(key)
+	el, found := s.data[key]
+	if !found {
+		return ErrNotFound
+	}
+	if _, found := dst.data[key]; found {
+		return ErrAlreadyExists
+	}
+	if err := dst.reserveUnsafe(); err != nil {
+		return err
+	}
+	exp, _ := el.Expire()
+	s.deleteUnsafe(key)
+	dst.data[key] = el
+	dst.indexUnsafe(key, el)
+	dst.countCompressedUnsafe(el, 1)
+	dst.used += itemSize(el)
+	dst.setExpireUnsafe(key, exp)
+	s.notify(EventDelete, key, "")
+	dst.notify(EventSet, key, "")
+	dst.evictUnsafe(key)
+	return nil
+}
@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// Loader loads value of key missing in Storage, e.g. from database
+type Loader func(key string) (interface{}, error)
+
+// loadCall is loader call in progress. Goroutines loading the same key
+// wait for it instead of calling loader again
+type loadCall struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+}
+
+// loadGroup deduplicates concurrent loads of the same key and caches
+// loader errors
+type loadGroup struct {
+	lock   sync.Mutex
+	calls  map[string]*loadCall
+	errors map[string]loadError
+}
+
+// loadError is loader error cached till time
+type loadError struct {
+	err   error
+	until time.Time
+}
+
+func newLoadGroup() *loadGroup {
+	return &loadGroup{calls: map[string]*loadCall{}, errors: map[string]loadError{}}
+}
+
+// GetOrLoad returns value of key. If key is missing, value is loaded by
+// load, saved with ttl and returned. Concurrent calls for the same key
+// share one load. Loader errors are returned to all waiting callers and
+// cached for ErrorTTL if set with WithErrorTTL. With WithRefreshAhead key
+// which expires soon is loaded again in background while current value
+// is returned
+func (s *Storage) GetOrLoad(key string, ttl int, load Loader) (interface{}, error) {
+	v, st, err := s.get(key)
+	if err == nil {
+		if st.stale {
+			s.revalidate(key, st, load)
+		} else {
+			s.refreshAhead(key, ttl, load)
+		}
+		return v, nil
+	}
+	if err != ErrNotFound {
+		return nil, err
+	}
+	if err := s.loads.cachedErr(key, s.clock.Now()); err != nil {
+		return nil, err
+	}
+	c, started := s.loads.start(key)
+	if started {
+		s.load(key, 0, ttl, load, c)
+	}
+	<-c.done
+	return c.val, c.err
+}
+
+// refreshAhead starts background load of key if it expires in less than
+// refresh interval and no load of key in progress
+func (s *Storage) refreshAhead(key string, ttl int, load Loader) {
+	if s.refresh <= 0 {
+		return
+	}
+	left, err := s.TTL(key)
+	if err != nil || time.Duration(left) * time.Second > s.refresh {
+		return
+	}
+	if c, started := s.loads.start(key); started {
+		s.loadBackground(key, 0, ttl, load, c)
+	}
+}
+
+// loadBackground runs load in own goroutine. Loader panic is logged
+// instead of crashing process, waiters of c get ErrLoaderPanic
+func (s *Storage) loadBackground(key string, soft, ttl int, load Loader, c *loadCall) {
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				s.log.Errorw("Loader panic", "key", key, "panic", r)
+			}
+		}()
+		s.load(key, soft, ttl, load, c)
+	}()
+}
+
+// load calls loader, saves loaded value with soft TTL (if positive) and
+// TTL and finishes call c
+func (s *Storage) load(key string, soft, ttl int, load Loader, c *loadCall) {
+	c.err = ErrLoaderPanic // Kept if loader panics
+	defer s.loads.finish(key, c)
+	c.val, c.err = load(key)
+	if c.err != nil {
+		s.log.Warnw("Unable load key", "key", key, "err", c.err)
+		if s.errorTTL > 0 {
+			now := s.clock.Now()
+			s.loads.cacheErr(key, c.err, now.Add(s.errorTTL), now)
+		}
+		return
+	}
+	if err := s.setLoaded(key, c.val, soft, ttl); err != nil {
+		c.val, c.err = nil, err
+	}
+}
+
+// setLoaded sets or replaces key with loaded value
+func (s *Storage) setLoaded(key string, val interface{}, soft, ttl int) error {
+	val = s.compress(val)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	s.dropExpiredUnsafe(key)
+	return s.setSoftUnsafe(key, val, soft, ttl)
+}
+
+// start returns call of key in progress or starts new one. started is
+// true if caller must run new call
+func (g *loadGroup) start(key string) (c *loadCall, started bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if c, found := g.calls[key]; found {
+		return c, false
+	}
+	c = &loadCall{done: make(chan struct{})}
+	g.calls[key] = c
+	return c, true
+}
+
+// finish removes finished call and wakes up waiting callers
+func (g *loadGroup) finish(key string, c *loadCall) {
+	g.lock.Lock()
+	delete(g.calls, key)
+	g.lock.Unlock()
+	close(c.done)
+}
+
+// cachedErr returns loader error of key cached till later than now
+func (g *loadGroup) cachedErr(key string, now time.Time) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	e, found := g.errors[key]
+	if !found {
+		return nil
+	}
+	if !now.Before(e.until) {
+		delete(g.errors, key)
+		return nil
+	}
+	return e.err
+}
+
+// cacheErr caches loader error of key till time. Errors of other keys
+// cached longer than till now are dropped
+func (g *loadGroup) cacheErr(key string, err error, until, now time.Time) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for k, e := range g.errors {
+		if !now.Before(e.until) {
+			delete(g.errors, k)
+		}
+	}
+	g.errors[key] = loadError{err: err, until: until}
+}
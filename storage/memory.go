@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"fmt"
+	"container/heap"
+)
+
+// Estimated overheads in bytes of map entry with Item, list or dict
+// header, list element and dict field. Sizes are estimates, real memory
+// usage of Go runtime isn't measured
+const (
+	itemOverhead      = 64
+	containerOverhead = 48
+	elemOverhead      = 32
+	fieldOverhead     = 48
+)
+
+// sizeOf estimates memory used by key and its value
+func sizeOf(key string, v interface{}) int64 {
+	return itemOverhead + int64(len(key)) + valueSize(v)
+}
+
+// valueSize estimates memory used by value. Lists and dicts include their
+// elements
+func valueSize(v interface{}) int64 {
+	switch t := v.(type) {
+	case string:
+		return int64(len(t))
+	case []byte:
+		return int64(len(t))
+	case *compressed:
+		return int64(len(t.data))
+	case nil, bool, int, int8, int16, int32, int64, uint, uint8, uint16,
+		uint32, uint64, float32, float64:
+		return 8
+	case *ItemList:
+		var n int64 = containerOverhead
+		for el := t.items.Front(); el != nil; el = el.Next() {
+			n += elemSize(el.Value)
+		}
+		return n
+	case map[string]interface{}:
+		var n int64 = containerOverhead
+		for k, val := range t {
+			n += fieldSize(k, val)
+		}
+		return n
+	}
+	return int64(len(fmt.Sprint(v)))
+}
+
+// elemSize estimates memory used by list element
+func elemSize(v interface{}) int64 {
+	return elemOverhead + valueSize(v)
+}
+
+// fieldSize estimates memory used by dict field
+func fieldSize(k string, v interface{}) int64 {
+	return fieldOverhead + int64(len(k)) + valueSize(v)
+}
+
+// tagsSize estimates memory used by item tags and their index entries
+func tagsSize(tags []string) int64 {
+	var n int64
+	for _, tag := range tags {
+		n += fieldOverhead + int64(len(tag))
+	}
+	return n
+}
+
+// itemSize returns estimated memory used by item
+func itemSize(el ItemInterface) int64 {
+	if it, ok := el.(*Item); ok {
+		return it.size
+	}
+	return sizeOf(el.Key(), rawValue(el))
+}
+
+// resizeUnsafe changes estimated size of item and Storage by delta
+func (s *Storage) resizeUnsafe(el ItemInterface, delta int64) {
+	s.used += delta
+	if it, ok := el.(*Item); ok {
+		it.size += delta
+	}
+}
+
+// KeySize is estimated memory used by key, see BiggestKeys
+type KeySize struct {
+	Key  string
+	Size int64
+}
+
+// MemoryUsage returns estimated memory used by key with its value in
+// bytes
+func (s *Storage) MemoryUsage(key string) (int64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return 0, ErrClosed
+	}
+	el, found := s.getUnsafe(key)
+	if !found {
+		return 0, ErrNotFound
+	}
+	return itemSize(el), nil
+}
+
+// BiggestKeys returns up to n keys using most memory, biggest first. Keys
+// of the same size are sorted by name
+func (s *Storage) BiggestKeys(n int) ([]KeySize, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	top := &keySizeHeap{}
+	now := s.now()
+	for key, el := range s.data {
+		if n < 1 || expired(el, now) {
+			continue
+		}
+		ks := KeySize{key, itemSize(el)}
+		if top.Len() < n {
+			heap.Push(top, ks)
+		} else if top.less(top.list[0], ks) {
+			top.list[0] = ks
+			heap.Fix(top, 0)
+		}
+	}
+	res := make([]KeySize, top.Len())
+	for i := len(res) - 1; i >= 0; i-- {
+		res[i] = heap.Pop(top).(KeySize)
+	}
+	return res, nil
+}
+
+// keySizeHeap is min-heap of keys by size, so smallest of biggest keys is
+// replaced when bigger key found
+type keySizeHeap struct {
+	list []KeySize
+}
+
+func (h *keySizeHeap) less(a, b KeySize) bool {
+	if a.Size != b.Size {
+		return a.Size < b.Size
+	}
+	return a.Key > b.Key
+}
+
+func (h *keySizeHeap) Len() int           { return len(h.list) }
+func (h *keySizeHeap) Less(i, j int) bool { return h.less(h.list[i], h.list[j]) }
+func (h *keySizeHeap) Swap(i, j int)      { h.list[i], h.list[j] = h.list[j], h.list[i] }
+func (h *keySizeHeap) Push(x interface{}) { h.list = append(h.list, x.(KeySize)) }
+
+func (h *keySizeHeap) Pop() interface{} {
+	last := h.list[len(h.list)-1]
+	h.list = h.list[:len(h.list)-1]
+	return last
+}
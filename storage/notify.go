@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// EventType is kind of key change Storage notifies subscribers about
+type EventType string
+
+const (
+	EventSet      EventType = "set"
+	EventUpdate   EventType = "update"
+	EventDelete   EventType = "delete"
+	EventExpired  EventType = "expired"
+	EventEvicted  EventType = "evicted"
+	EventListPush EventType = "lpush"
+	EventListPop  EventType = "lpop"
+	EventDictSet  EventType = "dset"
+	EventDictDel  EventType = "ddel"
+	EventFlush    EventType = "flush"
+)
+
+// EventTypes lists all known event types
+var EventTypes = []EventType{EventSet, EventUpdate, EventDelete, EventExpired,
+	EventEvicted, EventListPush, EventListPop, EventDictSet, EventDictDel,
+	EventFlush}
+
+// SubscriptionBuffer is size of Subscription channel. When subscriber
+// doesn't read events fast enough new events are dropped
+var SubscriptionBuffer = 256
+
+// Event describes one change of key. Field set for dict field changes only
+type Event struct {
+	Type  EventType
+	Key   string
+	Field string
+}
+
+// String returns event in "type key [field]" format
+func (e Event) String() string {
+	if e.Field == "" {
+		return string(e.Type) + " " + e.Key
+	}
+	return string(e.Type) + " " + e.Key + " " + e.Field
+}
+
+// Subscription receives events for keys matched by pattern. Channel C is
+// closed when subscription or Storage closed
+type Subscription struct {
+	C       <-chan Event
+	ch      chan Event
+	pattern string
+	events  map[EventType]struct{}
+	storage *Storage
+	dropped int64
+	once    sync.Once
+}
+
+// Subscribe returns Subscription for keys matched by glob pattern (see
+// MatchPattern for syntax). If no events passed, all events are delivered
+func (s *Storage) Subscribe(pattern string, events ...EventType) (*Subscription, error) {
+	if _, err := MatchPattern(pattern, ""); err != nil {
+		return nil, err
+	}
+	sub := &Subscription{
+		ch:      make(chan Event, SubscriptionBuffer),
+		pattern: pattern,
+		events:  map[EventType]struct{}{},
+		storage: s,
+	}
+	sub.C = sub.ch
+	for _, e := range events {
+		if !isEventType(e) {
+			return nil, ErrBadEvent
+		}
+		sub.events[e] = struct{}{}
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	s.subLock.Lock()
+	defer s.subLock.Unlock()
+	s.subs[sub] = struct{}{}
+	return sub, nil
+}
+
+// Close stops delivering events and closes channel C
+func (sub *Subscription) Close() {
+	sub.storage.subLock.Lock()
+	defer sub.storage.subLock.Unlock()
+	delete(sub.storage.subs, sub)
+	sub.close()
+}
+
+// Dropped returns number of events dropped because of full channel
+func (sub *Subscription) Dropped() int {
+	return int(atomic.LoadInt64(&sub.dropped))
+}
+
+func (sub *Subscription) close() {
+	sub.once.Do(func() { close(sub.ch) })
+}
+
+// match checks that subscription waits for event e
+func (sub *Subscription) match(e Event) bool {
+	if len(sub.events) > 0 {
+		if _, found := sub.events[e.Type]; !found {
+			return false
+		}
+	}
+	if e.Type == EventFlush {
+		return true // Flush touches all keys
+	}
+	ok, _ := MatchPattern(sub.pattern, e.Key)
+	return ok
+}
+
+// notify sends event to all matched subscriptions. It never blocks, so it
+// can be called with Storage lock held
+func (s *Storage) notify(t EventType, key, field string) {
+	s.subLock.Lock()
+	defer s.subLock.Unlock()
+	if len(s.subs) == 0 {
+		return
+	}
+	e := Event{Type: t, Key: key, Field: field}
+	for sub := range s.subs {
+		if !sub.match(e) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			atomic.AddInt64(&sub.dropped, 1)
+		}
+	}
+}
+
+// closeSubs closes all subscriptions. Used on Storage close
+func (s *Storage) closeSubs() {
+	s.subLock.Lock()
+	defer s.subLock.Unlock()
+	for sub := range s.subs {
+		sub.close()
+		delete(s.subs, sub)
+	}
+}
+
+func isEventType(t EventType) bool {
+	for _, e := range EventTypes {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
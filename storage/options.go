@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"time"
+	"github.com/avsolo/gache/lib"
+)
+
+// DefaultTickInterval is default interval of expire tracking
+const DefaultTickInterval = time.Second
+
+// Option configures Storage created by NewStorage or NewStorageContext
+type Option func(*Storage)
+
+// WithTickInterval sets how often expired keys are deleted. Keys expired
+// between ticks are deleted on next tick
+func WithTickInterval(d time.Duration) Option {
+	return func(s *Storage) {
+		if d > 0 {
+			s.tick = d
+		}
+	}
+}
+
+// WithMaxMemory limits estimated memory used by keys and values in bytes
+// (0 - unlimited). What happens on limit depends on eviction policy
+func WithMaxMemory(n int64) Option {
+	return func(s *Storage) {
+		s.maxMemory = n
+	}
+}
+
+// WithEvictionPolicy sets policy applied when MaxMemory reached, EvictNone
+// by default
+func WithEvictionPolicy(p EvictionPolicy) Option {
+	return func(s *Storage) {
+		s.policy = p
+	}
+}
+
+// WithClock sets source of current time used for TTL
+func WithClock(c Clock) Option {
+	return func(s *Storage) {
+		s.clock = c
+	}
+}
+
+// WithLogger sets logger of Storage instead of package one (see SetLogger)
+func WithLogger(l lib.LoggerInterface) Option {
+	return func(s *Storage) {
+		s.log = l
+	}
+}
+
+// WithErrorTTL makes GetOrLoad cache loader errors for d, so failing
+// loader isn't called for every request
+func WithErrorTTL(d time.Duration) Option {
+	return func(s *Storage) {
+		s.errorTTL = d
+	}
+}
+
+// WithRefreshAhead makes GetOrLoad load key again in background when key
+// expires in less than d
+func WithRefreshAhead(d time.Duration) Option {
+	return func(s *Storage) {
+		s.refresh = d
+	}
+}
+
+// WithCompression enables compression of string and []byte values not
+// shorter than threshold bytes, see SetCompression
+func WithCompression(threshold int) Option {
+	return func(s *Storage) {
+		s.compressMin = int64(threshold)
+	}
+}
+
+// WithLoader sets loader refreshing stale keys, see SetSoft
+func WithLoader(l Loader) Option {
+	return func(s *Storage) {
+		s.loader = l
+	}
+}
+
+// WithPersister sets Persister used by Snapshot and Close
+func WithPersister(p Persister) Option {
+	return func(s *Storage) {
+		s.persister = p
+	}
+}
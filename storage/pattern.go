@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"unicode/utf8"
+)
+
+// MatchPattern reports whether name matches glob pattern. '*' matches any
+// sequence of characters (including '/'), '?' matches one character,
+// '[abc]', '[a-z]' and '[^a-z]' (or '[!a-z]') match one character of
+// class and '\' escapes next character
+func MatchPattern(pattern, name string) (bool, error) {
+	if !validPattern(pattern) {
+		return false, ErrBadPattern
+	}
+	return matchGlob(pattern, name), nil
+}
+
+// validPattern checks that escapes and classes of pattern are complete
+func validPattern(p string) bool {
+	for i := 0; i < len(p); {
+		switch p[i] {
+		case '\\':
+			if i + 1 >= len(p) {
+				return false
+			}
+			i += 2
+		case '[':
+			end, _, ok := matchClass(p[i:], 0)
+			if !ok {
+				return false
+			}
+			i += end
+		default:
+			i++
+		}
+	}
+	return true
+}
+
+// matchGlob matches name by valid pattern. Mismatch after '*' retries with
+// '*' taking one more character, so it works without recursion
+func matchGlob(p, name string) bool {
+	px, nx := 0, 0
+	starPx, starNx := -1, -1
+	for px < len(p) || nx < len(name) {
+		if px < len(p) {
+			switch c := p[px]; c {
+			case '*':
+				starPx, starNx = px, nx
+				px++
+				continue
+			case '?':
+				if nx < len(name) {
+					_, n := utf8.DecodeRuneInString(name[nx:])
+					px, nx = px + 1, nx + n
+					continue
+				}
+			case '[':
+				if nx < len(name) {
+					r, n := utf8.DecodeRuneInString(name[nx:])
+					if end, ok, _ := matchClass(p[px:], r); ok {
+						px, nx = px + end, nx + n
+						continue
+					}
+				}
+			case '\\':
+				if nx < len(name) && p[px+1] == name[nx] {
+					px, nx = px + 2, nx + 1
+					continue
+				}
+			default:
+				if nx < len(name) && c == name[nx] {
+					px, nx = px + 1, nx + 1
+					continue
+				}
+			}
+		}
+		if starPx < 0 || starNx >= len(name) {
+			return false
+		}
+		_, n := utf8.DecodeRuneInString(name[starNx:])
+		starNx += n
+		px, nx = starPx + 1, starNx
+	}
+	return true
+}
+
+// matchClass matches r by class at start of p. Returns length of class,
+// whether r matched and false if class is incomplete
+func matchClass(p string, r rune) (int, bool, bool) {
+	i := 1
+	negate := i < len(p) && (p[i] == '^' || p[i] == '!')
+	if negate {
+		i++
+	}
+	matched := false
+	for first := true; i < len(p); first = false {
+		if p[i] == ']' && !first {
+			return i + 1, matched != negate, true
+		}
+		lo, n := classChar(p[i:])
+		if n == 0 {
+			return 0, false, false
+		}
+		i += n
+		hi := lo
+		if i + 1 < len(p) && p[i] == '-' && p[i+1] != ']' {
+			if hi, n = classChar(p[i+1:]); n == 0 || hi < lo {
+				return 0, false, false
+			}
+			i += n + 1
+		}
+		if lo <= r && r <= hi {
+			matched = true
+		}
+	}
+	return 0, false, false
+}
+
+// classChar returns first character of class and its length with escape.
+// Zero length means incomplete escape
+func classChar(p string) (rune, int) {
+	if p[0] == '\\' {
+		if len(p) < 2 {
+			return 0, 0
+		}
+		r, n := utf8.DecodeRuneInString(p[1:])
+		return r, n + 1
+	}
+	return utf8.DecodeRuneInString(p)
+}
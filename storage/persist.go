@@ -0,0 +1,38 @@
+package storage
+
+// Persister saves Storage items outside of memory. Persist is called with
+// Storage lock held, so it must not call any Storage method.
+type Persister interface {
+	Persist(items []ItemInterface) error
+}
+
+// SetPersister sets Persister used by Snapshot and Close. Nil disables
+// persistence
+func (s *Storage) SetPersister(p Persister) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.persister = p
+}
+
+// Snapshot saves all current items with Persister. If Persister isn't set
+// it does nothing
+func (s *Storage) Snapshot() error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if s.persister == nil {
+		return nil
+	}
+	return s.persister.Persist(s.itemsUnsafe())
+}
+
+// itemsUnsafe returns list of all items without any lock
+func (s *Storage) itemsUnsafe() []ItemInterface {
+	items := make([]ItemInterface, 0, len(s.data))
+	for _, el := range s.data {
+		items = append(items, el)
+	}
+	return items
+}
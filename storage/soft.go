@@ -0,0 +1,87 @@
+package storage
+
+import "sync/atomic"
+
+// softState describes soft expire of item read by get
+type softState struct {
+	stale  bool
+	soft   int // Soft and hard TTL set by SetSoft
+	ttl    int
+	loader Loader
+}
+
+// SetSoft sets key like Set, but value becomes stale after softTTL
+// seconds. Stale value is still returned by reads, but first read after
+// softTTL starts one background refresh by loader set with WithLoader or
+// SetLoader (GetOrLoad refreshes with its own loader). Refreshed value
+// gets the same soft and hard TTL. Key is deleted after ttl seconds as
+// usual; ttl must be greater than softTTL or non-positive
+func (s *Storage) SetSoft(key string, val interface{}, softTTL, ttl int) error {
+	if softTTL < 1 || (ttl > 0 && ttl <= softTTL) {
+		return ErrBadTTL
+	}
+	val = s.compress(val)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	s.dropExpiredUnsafe(key)
+	if _, found := s.data[key]; found {
+		return ErrAlreadyExists
+	}
+	return s.setSoftUnsafe(key, val, softTTL, ttl)
+}
+
+// GetStale is like Get, but also reports that value is stale
+func (s *Storage) GetStale(key string) (interface{}, bool, error) {
+	v, st, err := s.get(key)
+	if err != nil {
+		return nil, false, err
+	}
+	s.revalidate(key, st, st.loader)
+	return v, st.stale, nil
+}
+
+// SetLoader sets loader refreshing stale keys. Nil disables refresh
+func (s *Storage) SetLoader(l Loader) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.loader = l
+}
+
+// setSoftUnsafe sets key with soft TTL. Non-positive softTTL sets key
+// without it
+func (s *Storage) setSoftUnsafe(key string, val interface{}, softTTL, ttl int) error {
+	if err := s.setUnsafe(key, val, ttl); err != nil {
+		return err
+	}
+	if softTTL < 1 {
+		return nil
+	}
+	if it, ok := s.data[key].(*Item); ok {
+		it.soft, it.softTTL, it.hardTTL = s.now() + softTTL, softTTL, ttl
+	}
+	return nil
+}
+
+// softStateUnsafe returns soft expire state of item at now
+func softStateUnsafe(el ItemInterface, now int) softState {
+	it, ok := el.(*Item)
+	if !ok || it.soft == 0 {
+		return softState{}
+	}
+	return softState{stale: it.soft <= now, soft: it.softTTL, ttl: it.hardTTL}
+}
+
+// revalidate starts background refresh of stale key by load unless key
+// is already loading
+func (s *Storage) revalidate(key string, st softState, load Loader) {
+	if !st.stale || load == nil {
+		return
+	}
+	atomic.AddInt64(&s.counters.stale, 1)
+	if c, started := s.loads.start(key); started {
+		s.loadBackground(key, st.soft, st.ttl, load, c)
+	}
+}
@@ -0,0 +1,113 @@
+package storage
+
+import "sync/atomic"
+
+// Stats describes Storage content and usage
+type Stats struct {
+	Keys    int   // Number of keys
+	Strings int   // Keys with TypeString values
+	Lists   int   // Keys with TypeList values
+	Dicts   int   // Keys with TypeDict values
+	Expires int   // Keys with expire
+	Expired int64 // Keys deleted by expire
+	Evicted int64 // Keys deleted to free memory
+	Hits    int64 // Reads of existing keys
+	Misses  int64 // Reads of missing keys
+	Stale   int64 // Reads of stale keys with refresh loader
+	Memory  int64 // Estimated memory used by keys in bytes
+
+	Compressed     int   // Keys with compressed values
+	CompressedSize int64 // Size of compressed values
+	OriginalSize   int64 // Size of compressed values before compression
+}
+
+// CompressionRatio returns ratio of original to compressed size of
+// compressed values or 0 if there are no such values
+func (st Stats) CompressionRatio() float64 {
+	if st.CompressedSize == 0 {
+		return 0
+	}
+	return float64(st.OriginalSize) / float64(st.CompressedSize)
+}
+
+// compressionStats keeps totals of compressed values. It's changed under
+// write lock
+type compressionStats struct {
+	keys     int64
+	size     int64
+	original int64
+}
+
+// counters keeps Storage usage counters changed with atomic operations, so
+// they can be updated under read lock
+type counters struct {
+	expired int64
+	evicted int64
+	hits    int64
+	misses  int64
+	stale   int64
+}
+
+// Stats returns current Storage stats. It walks all keys to count types
+func (s *Storage) Stats() Stats {
+	st := Stats{
+		Expired: atomic.LoadInt64(&s.counters.expired),
+		Evicted: atomic.LoadInt64(&s.counters.evicted),
+		Hits:    atomic.LoadInt64(&s.counters.hits),
+		Misses:  atomic.LoadInt64(&s.counters.misses),
+		Stale:   atomic.LoadInt64(&s.counters.stale),
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	st.Keys = len(s.data)
+	st.Memory = s.used
+	st.Compressed = int(s.compressed.keys)
+	st.CompressedSize = s.compressed.size
+	st.OriginalSize = s.compressed.original
+	for _, el := range s.data {
+		switch typeOf(rawValue(el)) {
+		case TypeList:
+			st.Lists++
+		case TypeDict:
+			st.Dicts++
+		default:
+			st.Strings++
+		}
+	}
+	for _, keys := range s.expire {
+		st.Expires += len(keys)
+	}
+	return st
+}
+
+// Usage returns Keys, Memory and counters (Expired, Evicted, Hits, Misses,
+// Stale) of Stats. Unlike Stats it doesn't walk keys, so it's cheap to
+// call often
+func (s *Storage) Usage() Stats {
+	return Stats{
+		Keys:    s.Len(),
+		Memory:  s.MemoryUsed(),
+		Expired: atomic.LoadInt64(&s.counters.expired),
+		Evicted: atomic.LoadInt64(&s.counters.evicted),
+		Hits:    atomic.LoadInt64(&s.counters.hits),
+		Misses:  atomic.LoadInt64(&s.counters.misses),
+		Stale:   atomic.LoadInt64(&s.counters.stale),
+	}
+}
+
+// hit counts read of key
+func (s *Storage) hit(found bool) {
+	if found {
+		atomic.AddInt64(&s.counters.hits, 1)
+	} else {
+		atomic.AddInt64(&s.counters.misses, 1)
+	}
+}
+
+// expiredUnsafe deletes expired key and counts it
+func (s *Storage) expiredUnsafe(key string) {
+	if s.deleteUnsafe(key) {
+		atomic.AddInt64(&s.counters.expired, 1)
+		s.notify(EventExpired, key, "")
+	}
+}
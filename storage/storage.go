@@ -5,6 +5,8 @@ package storage
 import (
 	"sync"
 	"time"
+	"context"
+	"github.com/avsolo/gache/lib"
 )
 
 // Storage is core element, which consist data in map[string]interface{}
@@ -13,20 +15,99 @@ type Storage struct {
     lock sync.RWMutex
     data map[string]ItemInterface
 	expire map[int]map[string]struct{}
+	persister Persister
+	closed bool
+	done chan struct{}
+	stopped chan struct{}
+	subLock sync.Mutex
+	subs map[*Subscription]struct{}
+	counters counters
+	tick time.Duration
+	lastTick int // Last second checked by expire tracking
+	clock Clock
+	log lib.LoggerInterface
+	maxMemory int64
+	policy EvictionPolicy
+	used int64 // Estimated memory used by keys
+	accessSeq int64
+	loads *loadGroup
+	errorTTL time.Duration
+	refresh time.Duration
+	loader Loader // Refreshes stale keys
+	prefixes *prefixIndex // Secondary indexes for bulk deletes
+	tags map[string]map[string]struct{}
+	compressMin int64 // Min size of compressed values, 0 - disabled
+	compressed compressionStats
 }
 
 // NewStorage create a new instance of Storage. You can create any number of
 // Storage and all of them will be work separately. Also NewStorate start
-// expire traking - 1 sec timer. See startTiker for more details.
-func NewStorage() *Storage {
+// expire traking - 1 sec timer. See startTiker for more details. Storage
+// must be closed with Close when it's not needed anymore. Storage is
+// configured with options, e.g. NewStorage(WithMaxMemory(1 << 30))
+func NewStorage(opts ...Option) *Storage {
+	return NewStorageContext(context.Background(), opts...)
+}
+
+// NewStorageContext is like NewStorage, but Storage closed automatically
+// when ctx is done
+func NewStorageContext(ctx context.Context, opts ...Option) *Storage {
 	s := &Storage{
 		data: map[string]ItemInterface{},
 		expire: map[int]map[string]struct{}{},
-	}
-	go s.startTicker()
+		done: make(chan struct{}),
+		stopped: make(chan struct{}),
+		subs: map[*Subscription]struct{}{},
+		tick: DefaultTickInterval,
+		clock: SystemClock{},
+		log: log,
+		policy: EvictNone,
+		loads: newLoadGroup(),
+		prefixes: newPrefixIndex(),
+		tags: map[string]map[string]struct{}{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	go s.startTicker(ctx, s.clock.NewTicker(s.tick))
 	return s
 }
 
+// Close stops expire tracking, saves data with Persister if it set and
+// releases data. Any further call returns ErrClosed
+func (s *Storage) Close() error {
+	err := s.shutdown()
+	if err == ErrClosed {
+		return err
+	}
+	<-s.stopped // Wait for ticker exit
+	return err
+}
+
+// shutdown marks Storage as closed and releases data. It doesn't wait for
+// ticker, so it can be called from ticker itself
+func (s *Storage) shutdown() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	s.closed = true
+	close(s.done)
+	s.closeSubs()
+
+	var err error
+	if s.persister != nil {
+		err = s.persister.Persist(s.itemsUnsafe())
+	}
+	s.data = map[string]ItemInterface{}
+	s.expire = map[int]map[string]struct{}{}
+	s.used = 0
+	s.resetIndexesUnsafe()
+	s.compressed = compressionStats{}
+	return err
+}
+
 ///////////////////////////////////////////////////////////////////////////
 // Base getters/setters for struct{}
 ///////////////////////////////////////////////////////////////////////////
@@ -34,38 +115,87 @@ func NewStorage() *Storage {
 // Set find key with same name and if not exist - create on. If key
 // exists do nothing and return ErrAlreadyExists error
 func (s *Storage) Set(key string, val interface{}, ttl int) error {
+	val = s.compress(val)
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	s.dropExpiredUnsafe(key)
 	if _, found := s.data[key]; found {
 		return ErrAlreadyExists
 	}
 	return s.setUnsafe(key, val, ttl)
 }
 
-// setUnsafe sets key/value to data and TTL
+// setUnsafe sets key/value to data and TTL and notifies subscribers.
+// Non-positive ttl means key never expires
 func (s *Storage) setUnsafe(key string, val interface{}, ttl int) error {
-	s.data[key] = NewItem(key, val)
-	s.data[key].SetExpire(MakeTTLStamp(ttl))
-	s.setTTLUnsafe(key, ttl)
+	if err := s.reserveUnsafe(); err != nil {
+		return err
+	}
+	event := EventSet
+	el := NewItem(key, val)
+	if old, found := s.data[key]; found {
+		s.setExpireUnsafe(key, NoExpire) // Drop expire of replaced item
+		s.used -= itemSize(old)
+		s.unindexUnsafe(key, old)
+		s.countCompressedUnsafe(old, -1)
+		el.(*Item).tags = itemTags(old) // Replaced value keeps tags
+		event = EventUpdate
+	}
+	s.data[key] = el
+	s.indexUnsafe(key, el)
+	s.countCompressedUnsafe(el, 1)
+	s.resizeUnsafe(el, sizeOf(key, val) + tagsSize(itemTags(el)))
+	s.touch(el)
+	if err := s.setTTLUnsafe(key, ttl); err != nil {
+		return err
+	}
+	s.notify(event, key, "")
+	s.evictUnsafe(key)
 	return nil
 }
 
 // Get finds and return key from Storage. It uses internal Go mechanism
-// and return bool as second argument
+// and return bool as second argument. Stale value (see SetSoft) is
+// returned too
 func (s *Storage) Get(key string) (interface{}, error) {
+	v, st, err := s.get(key)
+	if err == nil {
+		s.revalidate(key, st, st.loader)
+	}
+	return v, err
+}
+
+// get returns value of key and its soft expire state
+func (s *Storage) get(key string) (interface{}, softState, error) {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
-	if d, found := s.data[key]; found {
-		return d.Value(), nil
-	}
-	return nil, ErrNotFound
+	if s.closed {
+		return nil, softState{}, ErrClosed
+	}
+	d, found := s.getUnsafe(key)
+	s.hit(found)
+	if found {
+		s.touch(d)
+		st := softStateUnsafe(d, s.now())
+		st.loader = s.loader
+		return d.Value(), st, nil
+	}
+	return nil, softState{}, ErrNotFound
 }
 
 // Update finds key in Storage and set new val and ttl if key found
 // If not, return ErrNotFound error
 func (s *Storage) Update(key string, val interface{}, ttl int) error {
+	val = s.compress(val)
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	s.dropExpiredUnsafe(key)
 	if _, found := s.data[key]; !found {
 		return ErrNotFound
 	}
@@ -76,14 +206,25 @@ func (s *Storage) Update(key string, val interface{}, ttl int) error {
 func (s *Storage) Delete(key string) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	s.dropExpiredUnsafe(key)
+	if s.deleteUnsafe(key) {
+		s.notify(EventDelete, key, "")
+	}
+}
+
+// deleteUnsafe removes key and its expire tracking without any lock.
+// Returns false if key not found
+func (s *Storage) deleteUnsafe(key string) bool {
 	el, found := s.data[key]
 	if !found {
-		return
-	}
-	if exp, ok := el.Expire(); ok {
-		delete(s.expire[exp], el.Key())
+		return false
 	}
+	s.setExpireUnsafe(key, NoExpire)
+	s.used -= itemSize(el)
+	s.unindexUnsafe(key, el)
+	s.countCompressedUnsafe(el, -1)
 	delete(s.data, key)
+	return true
 }
 
 ///////////////////////////////////////////////////////////////////////////
@@ -95,6 +236,10 @@ func (s *Storage) Delete(key string) {
 func (s *Storage) LSet(key string, args ...interface{}) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	s.dropExpiredUnsafe(key)
 	if _, found := s.data[key]; found {
 		return ErrAlreadyExists
 	}
@@ -114,10 +259,15 @@ func (s *Storage) LSet(key string, args ...interface{}) error {
 func (s *Storage) LGet(key string) (ItemListInterface, error) {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
-	d, found := s.data[key]
+	if s.closed {
+		return nil, ErrClosed
+	}
+	d, found := s.getUnsafe(key)
+	s.hit(found)
 	if !found {
 		return nil, ErrNotFound
 	}
+	s.touch(d)
 	if itemList, ok := (d.Value()).(ItemListInterface); ok {
 		return itemList, nil
 	}
@@ -127,6 +277,7 @@ func (s *Storage) LGet(key string) (ItemListInterface, error) {
 // getListUnsafe returns data withot sync.RLock. This method must be used
 // with care and in the same gorutine
 func (s *Storage) getListUnsafe(key string) (ItemListInterface, error) {
+	s.dropExpiredUnsafe(key)
 	el, found := s.data[key]
 	if !found {
 		return nil, ErrNotFound
@@ -142,17 +293,28 @@ func (s *Storage) getListUnsafe(key string) (ItemListInterface, error) {
 func (s *Storage) LPush(key string, val interface{}) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	s.dropExpiredUnsafe(key)
 	el, found := s.data[key]
 	if !found {
-		log.Warnf("Key '%s' not found", key)
+		s.log.Warnf("Key '%s' not found", key)
 		return ErrNotFound
 	}
 	list, ok := (el.Value()).(ItemListInterface)
 	if !ok {
-		log.Warnf("Key '%s' not list", key)
+		s.log.Warnf("Key '%s' not list", key)
 		return ErrNotList
 	}
+	if err := s.reserveUnsafe(); err != nil {
+		return err
+	}
 	list.Push(val)
+	s.resizeUnsafe(el, elemSize(val))
+	s.touch(el)
+	s.notify(EventListPush, key, "")
+	s.evictUnsafe(key)
 	return nil
 }
 
@@ -160,12 +322,17 @@ func (s *Storage) LPush(key string, val interface{}) error {
 func (s *Storage) LPop(key string) (interface{}, error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
 	l, err := s.getListUnsafe(key)
 	if err != nil {
 		return nil, err
 	}
 
 	if res, found := l.Pop(); found {
+		s.resizeUnsafe(s.data[key], -elemSize(res))
+		s.notify(EventListPop, key, "")
 		return res, nil
 	}
 	return nil, ErrNotFound
@@ -179,6 +346,10 @@ func (s *Storage) LPop(key string) (interface{}, error) {
 func (s *Storage) DSet(key string, args ...interface{}) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	s.dropExpiredUnsafe(key)
 	if _, found := s.data[key]; found {
 		return ErrAlreadyExists
 	}
@@ -216,20 +387,25 @@ func (s *Storage) DSet(key string, args ...interface{}) error {
 func (s *Storage) DGet(rkey, skey string) (interface{}, error) {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
-	d, found := s.data[rkey]
+	if s.closed {
+		return nil, ErrClosed
+	}
+	d, found := s.getUnsafe(rkey)
+	s.hit(found)
 	if !found {
-		log.Warnf("RKey %s not found for dict", rkey)
+		s.log.Warnf("RKey %s not found for dict", rkey)
 		return nil, ErrNotFound
 	}
+	s.touch(d)
 	itemMap, ok := (d.Value()).(map[string]interface{})
 	if ok {
 		if val, found := itemMap[skey]; found {
 			return val, nil
 		}
-		log.Warnf("SKey %s not found for dict", skey)
+		s.log.Warnf("SKey %s not found for dict", skey)
 		return nil, ErrNotFound
 	}
-	log.Warnf("Key %s not dict", rkey)
+	s.log.Warnf("Key %s not dict", rkey)
 	return nil, ErrNotDict
 }
 
@@ -237,6 +413,10 @@ func (s *Storage) DGet(rkey, skey string) (interface{}, error) {
 func (s *Storage) DAdd(rkey, skey string, val interface{}) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	s.dropExpiredUnsafe(rkey)
 	el, found := s.data[rkey]
 	if !found {
 		return ErrNotFound
@@ -245,9 +425,19 @@ func (s *Storage) DAdd(rkey, skey string, val interface{}) error {
     if !ok {
         return ErrNotDict
 	}
+	if err := s.reserveUnsafe(); err != nil {
+		return err
+	}
+	if old, found := hash[skey]; found {
+		s.resizeUnsafe(el, -fieldSize(skey, old))
+	}
     hash[skey] = val
     el.SetValue(hash)
     s.data[rkey] = el
+	s.resizeUnsafe(el, fieldSize(skey, val))
+	s.touch(el)
+    s.notify(EventDictSet, rkey, skey)
+	s.evictUnsafe(rkey)
     return nil
 }
 
@@ -255,13 +445,16 @@ func (s *Storage) DAdd(rkey, skey string, val interface{}) error {
 func (s *Storage) DDel(rkey, skey string) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	s.dropExpiredUnsafe(rkey)
 	m, found := s.data[rkey]
 	if !found {
 		return
 	}
 	if itemMap, ok := (m.Value()).(map[string]interface{}); ok {
-		if _, found := itemMap[skey]; found {
+		if old, found := itemMap[skey]; found {
+			s.resizeUnsafe(m, -fieldSize(skey, old))
 			delete(itemMap, skey)
+			s.notify(EventDictDel, rkey, skey)
 		}
 	}
 	return
@@ -271,33 +464,90 @@ func (s *Storage) DDel(rkey, skey string) {
 // TTL and tiker
 ///////////////////////////////////////////////////////////////////////////////
 
-// SetTTL is find and remove old expire value and set new one
+// SetTTL is find and remove old expire value and set new one. Non-positive
+// ttl removes expire, so key will live until deleted
 func (s *Storage) SetTTL(key string, ttl int) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	s.dropExpiredUnsafe(key)
 	return s.setTTLUnsafe(key, ttl)
 }
 
+// ExpireAt sets absolute unix timestamp when key must expire. If stamp is
+// already in the past key deleted immediately
+func (s *Storage) ExpireAt(key string, stamp int) error {
+	if stamp < 1 {
+		return ErrBadTTL
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	s.dropExpiredUnsafe(key)
+	if _, found := s.data[key]; !found {
+		return ErrNotFound
+	}
+	if stamp <= s.now() {
+		s.expiredUnsafe(key)
+		return nil
+	}
+	return s.setExpireUnsafe(key, stamp)
+}
+
+// Persist removes expire from key. Returns ErrNoExpire if key has no expire
+func (s *Storage) Persist(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if _, err := s.getExpireUnsafe(key); err != nil {
+		return err
+	}
+	return s.setExpireUnsafe(key, NoExpire)
+}
+
 func (s *Storage) DeleteTTL(exp int) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
 	delete(s.expire, exp)
 	return nil
 }
 
 // setTTLUnsafe isn't set any thread lock while it's set expire value
 func (s *Storage) setTTLUnsafe(key string, ttl int) error {
+	if ttl < 1 {
+		return s.setExpireUnsafe(key, NoExpire)
+	}
+	return s.setExpireUnsafe(key, s.now() + ttl)
+}
+
+// setExpireUnsafe moves key from current expire stamp to new one. NoExpire
+// stamp just removes key from expire tracking
+func (s *Storage) setExpireUnsafe(key string, stamp int) error {
 	el, found := s.data[key]
 	if !found {
 		return ErrNotFound
 	}
-	cur, err := s.getExpireUnsafe(key)
-	if err == nil {
+	if cur, ok := el.Expire(); ok {
 		delete(s.expire[cur], key) // Remove current expire value
+		if len(s.expire[cur]) == 0 {
+			delete(s.expire, cur)
+		}
 	}
-	el.SetExpire(MakeTTLStamp(ttl)) // Update expire in Item
+	el.SetExpire(stamp) // Update expire in Item
 
-	t := MakeTTLStamp(ttl)
+	t, ok := el.Expire()
+	if !ok {
+		return nil
+	}
 	_, found = s.expire[t]
 	if ! found {
 		s.expire[t] = map[string]struct{}{}
@@ -306,15 +556,37 @@ func (s *Storage) setTTLUnsafe(key string, ttl int) error {
 	return nil
 }
 
-// GetTTL returns amount of seconds till key will expire
+// GetExpire returns absolute timestamp when key will expire
 func (s *Storage) GetExpire(key string) (int, error) {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
+	if s.closed {
+		return NoExpire, ErrClosed
+	}
 	return s.getExpireUnsafe(key)
 }
 
+// TTL returns amount of seconds till key will expire. For key without
+// expire returns NoExpire and ErrNoExpire
+func (s *Storage) TTL(key string) (int, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return NoExpire, ErrClosed
+	}
+	exp, err := s.getExpireUnsafe(key)
+	if err != nil {
+		return NoExpire, err
+	}
+	ttl := exp - s.now()
+	if ttl < 0 {
+		ttl = 0
+	}
+	return ttl, nil
+}
+
 func (s *Storage) getExpireUnsafe(key string) (int, error) {
-	el, found := s.data[key]
+	el, found := s.getUnsafe(key)
 	if !found {
 		return NoExpire, ErrNotFound
 	}
@@ -325,34 +597,113 @@ func (s *Storage) getExpireUnsafe(key string) (int, error) {
 	return exp, nil
 }
 
-// startTicker is timer with 1 sec tick, which finds timestamp key in 
-// ExpireList.expire and then delete keys from ExpireList.data which has expire time
-func (s *Storage) startTicker() {
-	ticker := time.NewTicker(1 * time.Second)
-	for tick := range ticker.C {
-		t := int(tick.Unix())
-		items, found := s.expire[t]
-		if !found {
-			continue
+// startTicker is timer with tick interval (1 sec by default), which finds
+// expired timestamps in ExpireList.expire and then delete keys from
+// ExpireList.data which has expire time. Ticker stops when Storage closed
+// or ctx is done. Ticker is created by constructor, so it sees any time
+// change made after NewStorage returned
+func (s *Storage) startTicker(ctx context.Context, ticker Ticker) {
+	defer func() {
+		ticker.Stop()
+		close(s.stopped)
+	}()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ctx.Done():
+			if err := s.shutdown(); err != nil && err != ErrClosed {
+				s.log.Errorf("Unable close storage: %v", err)
+			}
+			return
+		case <-ticker.C():
+			s.expireUntil(s.now())
 		}
-		for key, _ :=range items {
-			delete(items, key)
-			s.Delete(key)
+	}
+}
+
+// expireUntil deletes all keys which expire at now timestamp or before.
+// Every second since previous call is checked, so keys aren't missed if
+// ticks are late or tick interval is longer than second
+func (s *Storage) expireUntil(now int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.lastTick == 0 || now - s.lastTick > len(s.expire) {
+		for t := range s.expire { // Cheaper than checking every second
+			if t <= now {
+				s.expireStampUnsafe(t)
+			}
 		}
+	} else {
+		for t := s.lastTick + 1; t <= now; t++ {
+			s.expireStampUnsafe(t)
+		}
+	}
+	s.lastTick = now
+}
+
+// expireStampUnsafe deletes all keys which expire at t timestamp
+func (s *Storage) expireStampUnsafe(t int) {
+	items, found := s.expire[t]
+	if !found {
+		return
+	}
+	for key, _ := range items {
+		s.expiredUnsafe(key)
+	}
+	delete(s.expire, t)
+}
+
+// now returns current unix timestamp of Storage clock
+func (s *Storage) now() int {
+	return int(s.clock.Now().Unix())
+}
+
+// expired checks that item expire time passed at now. Such item may be
+// not deleted by expire tracking yet, but it's treated as missing
+func expired(el ItemInterface, now int) bool {
+	exp, ok := el.Expire()
+	return ok && exp <= now
+}
+
+// getUnsafe returns item of key if it isn't expired. It's safe under read
+// lock
+func (s *Storage) getUnsafe(key string) (ItemInterface, bool) {
+	el, found := s.data[key]
+	if !found || expired(el, s.now()) {
+		return nil, false
+	}
+	return el, true
+}
+
+// dropExpiredUnsafe deletes key if it's expired, so writes see it missing.
+// It requires write lock
+func (s *Storage) dropExpiredUnsafe(key string) {
+	if el, found := s.data[key]; found && expired(el, s.now()) {
+		s.expiredUnsafe(key)
 	}
 }
 
 // Flush recursively delete keys and exprire data from Storage
 func (s *Storage) Flush() {
-	for k, v := range s.data {
-		delete(s.data, k)
-		if exp, ok := v.Expire(); ok {
-			delete(s.expire, exp)
-		}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
 	}
+	s.data = map[string]ItemInterface{}
+	s.expire = map[int]map[string]struct{}{}
+	s.used = 0
+	s.resetIndexesUnsafe()
+	s.compressed = compressionStats{}
+	s.notify(EventFlush, "", "")
 }
 
-// MakeTTLStamp calculate absolute timestamp from ttl seconds
+// MakeTTLStamp calculate absolute timestamp from ttl seconds by system
+// time. Non-positive ttl returns NoExpire. Storage uses its own Clock
 func MakeTTLStamp(ttl int) int {
+	if ttl < 1 {
+		return NoExpire
+	}
 	return int(time.Now().Add(time.Duration(int64(ttl)) * time.Second).Unix())
 }
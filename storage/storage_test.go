@@ -2,10 +2,14 @@ package storage
 
 import (
 	"fmt"
+	"bytes"
+	"context"
 	"time"
 	"testing"
 	"strings"
+	"sync"
 	"math/rand"
+	"sync/atomic"
 	"crypto/md5"
 	"github.com/stretchr/testify/assert"
 
@@ -40,6 +44,7 @@ func makeTestItem() (key string, item *TestItem, ttl int) {
 func TestSetSuccess(t *testing.T) {
 	// Ok item
 	s := storage.NewStorage()
+	defer s.Close()
 	keyOk, itemOk, ttl := makeTestItem()
 	// Wrong item
 	_, itemWrong, ttlWrong := makeTestItem()
@@ -65,6 +70,7 @@ func TestSetSuccess(t *testing.T) {
 func TestUpdateSuccess(t *testing.T) {
 	// Prepare
 	s := storage.NewStorage()
+	defer s.Close()
 	key, item, ttl := makeTestItem()
 	_ = s.Set(key, item, ttl)
 
@@ -81,6 +87,7 @@ func TestUpdateSuccess(t *testing.T) {
 
 func TestDeleteSuccess(t *testing.T) {
 	s := storage.NewStorage()
+	defer s.Close()
 	key, item, ttl := makeTestItem()
 	_ = s.Set(key, item, ttl)
 
@@ -95,25 +102,997 @@ func TestDeleteSuccess(t *testing.T) {
 
 // Expire /////////////////////////////////////////////////////////////////////
 
+// newFakeStorage creates Storage with FakeClock and other options
+func newFakeStorage(opts ...storage.Option) (*storage.Storage, *storage.FakeClock) {
+	clock := storage.NewFakeClock(time.Unix(1500000000, 0))
+	return storage.NewStorage(append(opts, storage.WithClock(clock))...), clock
+}
+
 func TestExpireSuccess(t *testing.T) {
-	s := storage.NewStorage()
+	s, clock := newFakeStorage()
+	defer s.Close()
 	key, item, _ := makeTestItem()
 	ttl := 2
 
 	// Set, and check while key expired
 	_ = s.Set(key, item, ttl)
-
-	// Wait and check that our key not exists
-	time.Sleep(time.Duration(ttl + 1) * time.Second)
+	clock.Advance(time.Duration(ttl - 1) * time.Second)
 	itemGet, err := s.Get(key)
+	assert.Nil(t, err)
+	ttlGet, _ := s.TTL(key)
+	assert.Equal(t, 1, ttlGet)
+
+	// Key expired as soon as time passed
+	clock.Advance(time.Second)
+	itemGet, err = s.Get(key)
 	assert.Equal(t, storage.ErrNotFound, err, "Wrong error type while returning expired item")
 	assert.Nil(t, itemGet, "Value was changed (must to be expired)")
+	assert.Equal(t, 0, s.Exists(key))
+	keys, _ := s.Keys("*")
+	assert.Equal(t, 0, len(keys))
+
+	// Expired key can be set again
+	assert.Nil(t, s.Set(key, item, ttl))
+}
+
+func TestExpireTickerSuccess(t *testing.T) {
+	s, clock := newFakeStorage()
+	defer s.Close()
+	sub, _ := s.Subscribe("*", storage.EventExpired)
+	_ = s.Set("k1", 1, 1)
+	_ = s.Set("k2", 2, 5)
+	_ = s.Set("k3", 3, 0)
+
+	// Expire tracking deletes keys of all passed seconds
+	clock.Advance(10 * time.Second)
+	for _, key := range []string{"k1", "k2"} {
+		e := <-sub.C
+		assert.Equal(t, storage.EventExpired, e.Type)
+		assert.Contains(t, []string{"k1", "k2"}, e.Key, key)
+	}
+	assert.Equal(t, 1, s.Len())
+	assert.Equal(t, int64(2), s.Stats().Expired)
+}
+
+func TestNoExpireSuccess(t *testing.T) {
+	s := storage.NewStorage()
+	defer s.Close()
+	key, item, _ := makeTestItem()
+
+	// Zero and negative TTL means key never expires
+	_ = s.Set(key, item, 0)
+	ttl, err := s.TTL(key)
+	assert.Equal(t, storage.ErrNoExpire, err)
+	assert.Equal(t, storage.NoExpire, ttl)
+
+	err = s.Update(key, item, -10)
+	assert.Nil(t, err)
+	_, err = s.GetExpire(key)
+	assert.Equal(t, storage.ErrNoExpire, err)
+}
+
+func TestExpireAtPersistSuccess(t *testing.T) {
+	s, clock := newFakeStorage()
+	defer s.Close()
+	key, item, _ := makeTestItem()
+	_ = s.Set(key, item, 100)
+
+	// Absolute timestamp
+	stamp := int(clock.Now().Unix()) + 50
+	err := s.ExpireAt(key, stamp)
+	assert.Nil(t, err)
+	exp, err := s.GetExpire(key)
+	assert.Equal(t, stamp, exp)
+	ttl, err := s.TTL(key)
+	assert.Equal(t, 50, ttl)
+
+	// Remove expire
+	err = s.Persist(key)
+	assert.Nil(t, err)
+	err = s.Persist(key)
+	assert.Equal(t, storage.ErrNoExpire, err)
+
+	// Timestamp in the past deletes key
+	err = s.ExpireAt(key, int(clock.Now().Unix()) - 1)
+	assert.Nil(t, err)
+	_, err = s.Get(key)
+	assert.Equal(t, storage.ErrNotFound, err)
+}
+
+// Close //////////////////////////////////////////////////////////////////////
+
+type testPersister struct {
+	items []storage.ItemInterface
+}
+
+func (p *testPersister) Persist(items []storage.ItemInterface) error {
+	p.items = items
+	return nil
+}
+
+func TestCloseSuccess(t *testing.T) {
+	s := storage.NewStorage()
+	p := &testPersister{}
+	s.SetPersister(p)
+	key, item, ttl := makeTestItem()
+	_ = s.Set(key, item, ttl)
+
+	// Close persists data
+	err := s.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(p.items))
+	assert.Equal(t, key, p.items[0].Key())
+
+	// Any further call denied
+	err = s.Close()
+	assert.Equal(t, storage.ErrClosed, err)
+	err = s.Set(key, item, ttl)
+	assert.Equal(t, storage.ErrClosed, err)
+	_, err = s.Get(key)
+	assert.Equal(t, storage.ErrClosed, err)
+}
+
+func TestStorageContextSuccess(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := storage.NewStorageContext(ctx)
+	key, item, ttl := makeTestItem()
+	err := s.Set(key, item, ttl)
+	assert.Nil(t, err)
+
+	// Storage closed when context canceled
+	cancel()
+	for i := 0; i < 100; i++ {
+		if _, err = s.Get(key); err == storage.ErrClosed {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, storage.ErrClosed, err)
+	assert.Equal(t, storage.ErrClosed, s.Close())
+}
+
+// Notifications //////////////////////////////////////////////////////////////
+
+// checkEvent reads one event from subscription and compares with expected
+func checkEvent(t *testing.T, sub *storage.Subscription, expected storage.Event) {
+	select {
+	case e := <-sub.C:
+		assert.Equal(t, expected, e)
+	case <-time.After(time.Second):
+		t.Errorf("Event %v not received", expected)
+	}
+}
+
+func TestSubscribeSuccess(t *testing.T) {
+	s := storage.NewStorage()
+	defer s.Close()
+	sub, err := s.Subscribe("user*")
+	assert.Nil(t, err)
+
+	_ = s.Set("other", 1, 0) // Not matched
+	_ = s.Set("user1", 1, 0)
+	_ = s.Update("user1", 2, 0)
+	_ = s.DSet("user2", "k1", 1, 0)
+	_ = s.DAdd("user2", "k2", 2)
+	s.DDel("user2", "k1")
+	_ = s.LSet("user3", 1, 0)
+	_ = s.LPush("user3", 2)
+	_, _ = s.LPop("user3")
+	s.Delete("user1")
+	_ = s.ExpireAt("user2", 1)
+
+	checkEvent(t, sub, storage.Event{Type: storage.EventSet, Key: "user1"})
+	checkEvent(t, sub, storage.Event{Type: storage.EventUpdate, Key: "user1"})
+	checkEvent(t, sub, storage.Event{Type: storage.EventSet, Key: "user2"})
+	checkEvent(t, sub, storage.Event{Type: storage.EventDictSet, Key: "user2", Field: "k2"})
+	checkEvent(t, sub, storage.Event{Type: storage.EventDictDel, Key: "user2", Field: "k1"})
+	checkEvent(t, sub, storage.Event{Type: storage.EventSet, Key: "user3"})
+	checkEvent(t, sub, storage.Event{Type: storage.EventListPush, Key: "user3"})
+	checkEvent(t, sub, storage.Event{Type: storage.EventListPop, Key: "user3"})
+	checkEvent(t, sub, storage.Event{Type: storage.EventDelete, Key: "user1"})
+	checkEvent(t, sub, storage.Event{Type: storage.EventExpired, Key: "user2"})
+
+	// Channel closed after Close
+	sub.Close()
+	_, ok := <-sub.C
+	assert.False(t, ok)
+}
+
+func TestSubscribeEventsSuccess(t *testing.T) {
+	s := storage.NewStorage()
+	sub, err := s.Subscribe("*", storage.EventDelete)
+	assert.Nil(t, err)
+
+	_ = s.Set("k1", 1, 0)
+	s.Delete("k1")
+	checkEvent(t, sub, storage.Event{Type: storage.EventDelete, Key: "k1"})
+
+	// Wrong arguments
+	_, err = s.Subscribe("[", storage.EventDelete)
+	assert.Equal(t, storage.ErrBadPattern, err)
+	_, err = s.Subscribe("*", "unknown")
+	assert.Equal(t, storage.ErrBadEvent, err)
+
+	// Storage close closes subscriptions
+	s.Close()
+	_, ok := <-sub.C
+	assert.False(t, ok)
+}
+
+// Keys ///////////////////////////////////////////////////////////////////////
+
+func TestKeysSuccess(t *testing.T) {
+	s := storage.NewStorage()
+	defer s.Close()
+	_ = s.Set("user1", 1, 0)
+	_ = s.Set("user2", 2, 0)
+	_ = s.LSet("list", 1, 0)
+	_ = s.DSet("dict", "k", "v", 0)
+
+	keys, err := s.Keys("user*")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"user1", "user2"}, keys)
+	_, err = s.Keys("[")
+	assert.Equal(t, storage.ErrBadPattern, err)
+
+	assert.Equal(t, 2, s.Exists("user1", "list", "unknown"))
+
+	for key, exp := range map[string]string{"user1": storage.TypeString,
+		"list": storage.TypeList, "dict": storage.TypeDict} {
+		typ, err := s.Type(key)
+		assert.Nil(t, err)
+		assert.Equal(t, exp, typ)
+	}
+	_, err = s.Type("unknown")
+	assert.Equal(t, storage.ErrNotFound, err)
+
+	key, err := s.RandomKey()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, s.Exists(key))
+}
+
+func TestMatchPattern(t *testing.T) {
+	for _, c := range []struct {
+		pattern, name string
+		match bool
+	}{
+		{"*", "a/b", true},
+		{"user:*", "user:42/orders", true},
+		{"a*b*c", "a/x/b/y/c", true},
+		{"a*b", "a/b/c", false},
+		{"?", "/", true},
+		{"k?y", "käy", true},
+		{"k[a-c]y", "kby", true},
+		{"k[^a-c]y", "kby", false},
+		{"k[!a-c]y", "kdy", true},
+		{"k[]]y", "k]y", true},
+		{`k\*y`, "k*y", true},
+		{`k\*y`, "kxy", false},
+		{"", "", true},
+		{"", "a", false},
+	} {
+		ok, err := storage.MatchPattern(c.pattern, c.name)
+		assert.Nil(t, err)
+		assert.Equal(t, c.match, ok, c.pattern + " " + c.name)
+	}
+	for _, p := range []string{"[", "[a-", "[]", "a\\", "[z-a]"} {
+		_, err := storage.MatchPattern(p, "")
+		assert.Equal(t, storage.ErrBadPattern, err, p)
+	}
+
+	// Keys and subscriptions see keys with '/'
+	s := storage.NewStorage()
+	defer s.Close()
+	sub, _ := s.Subscribe("*", storage.EventSet)
+	assert.Nil(t, s.Set("a/b", 1, 0))
+	checkEvent(t, sub, storage.Event{Type: storage.EventSet, Key: "a/b"})
+	keys, _ := s.Keys("*")
+	assert.Equal(t, []string{"a/b"}, keys)
+}
+
+func TestScanSuccess(t *testing.T) {
+	s := storage.NewStorage()
+	defer s.Close()
+	for i := 0; i < 25; i++ {
+		_ = s.Set(_s("key%02d", i), i, 0)
+	}
+
+	found := map[string]int{}
+	cursor, calls := storage.ScanStart, 0
+	for {
+		next, keys, err := s.Scan(cursor, "key*", 10)
+		assert.Nil(t, err)
+		for _, k := range keys {
+			found[k]++
+		}
+		// Modify storage between calls
+		if calls == 0 {
+			s.Delete("key00")
+			_ = s.Set("key99", 99, 0)
+		}
+		calls++
+		if cursor = next; cursor == storage.ScanStart {
+			break
+		}
+	}
+	assert.Equal(t, 3, calls)
+	for i := 0; i < 25; i++ {
+		assert.Equal(t, 1, found[_s("key%02d", i)], _s("key%02d", i))
+	}
+	assert.Equal(t, 1, found["key99"])
+
+	_, _, err := s.Scan("zz", "*", 10)
+	assert.Equal(t, storage.ErrBadCursor, err)
+
+	// Keys returned in lexical order by any count
+	all, _ := s.Keys("*")
+	for _, count := range []int{1, 7, 100} {
+		scanned, cursor := []string{}, storage.ScanStart
+		for {
+			next, keys, err := s.Scan(cursor, "*", count)
+			assert.Nil(t, err)
+			assert.True(t, len(keys) <= count)
+			scanned = append(scanned, keys...)
+			if cursor = next; cursor == storage.ScanStart {
+				break
+			}
+		}
+		assert.Equal(t, all, scanned)
+	}
+}
+
+func TestRenameSuccess(t *testing.T) {
+	s := storage.NewStorage()
+	defer s.Close()
+	_ = s.Set("old", 1, 100)
+	_ = s.Set("other", 2, 0)
+	exp, _ := s.GetExpire("old")
+
+	err := s.Rename("old", "other")
+	assert.Equal(t, storage.ErrAlreadyExists, err)
+
+	err = s.Rename("old", "new")
+	assert.Nil(t, err)
+	_, err = s.Get("old")
+	assert.Equal(t, storage.ErrNotFound, err)
+	val, err := s.Get("new")
+	assert.Equal(t, 1, val)
+	newExp, err := s.GetExpire("new")
+	assert.Equal(t, exp, newExp, "Expire not moved")
+
+	err = s.Rename("unknown", "new2")
+	assert.Equal(t, storage.ErrNotFound, err)
+
+	s.Flush()
+	_, err = s.RandomKey()
+	assert.Equal(t, storage.ErrEmpty, err)
+}
+
+func TestMoveSuccess(t *testing.T) {
+	s1, s2 := storage.NewStorage(), storage.NewStorage()
+	defer s1.Close()
+	defer s2.Close()
+	_ = s1.Set("k1", 1, 100)
+	_ = s2.Set("k2", 2, 0)
+	exp, _ := s1.GetExpire("k1")
+
+	err := s1.Move("k1", s2)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, s1.Len())
+	assert.Equal(t, 2, s2.Len())
+	newExp, err := s2.GetExpire("k1")
+	assert.Equal(t, exp, newExp, "Expire not moved")
+
+	_ = s1.Set("k2", 1, 0)
+	err = s1.Move("k2", s2)
+	assert.Equal(t, storage.ErrAlreadyExists, err)
+	err = s1.Move("unknown", s2)
+	assert.Equal(t, storage.ErrNotFound, err)
+}
+
+func TestStats(t *testing.T) {
+	s := storage.NewStorage()
+	defer s.Close()
+	_ = s.Set("s1", "v", 100)
+	_ = s.Set("s2", "v", 0)
+	_ = s.LSet("l1", "a", "b", 0)
+	_ = s.DSet("d1", "k", "v", 0)
+	_, _ = s.Get("s1")
+	_, _ = s.Get("unknown")
+	_, _ = s.LGet("l1")
+	_ = s.ExpireAt("s2", 1)
+
+	st := s.Stats()
+	assert.Equal(t, 3, st.Keys)
+	assert.Equal(t, 1, st.Strings)
+	assert.Equal(t, 1, st.Lists)
+	assert.Equal(t, 1, st.Dicts)
+	assert.Equal(t, 1, st.Expires)
+	assert.Equal(t, int64(1), st.Expired)
+	assert.Equal(t, int64(2), st.Hits)
+	assert.Equal(t, int64(1), st.Misses)
+}
+
+func TestSetLogger(t *testing.T) {
+	var b bytes.Buffer
+	storage.SetLogger(lib.NewLoggerOutput("storage", lib.NewOutput(&b, lib.JSONEncoder{}, lib.LOG_DEBUG)))
+	defer storage.SetLogger(lib.NewLogger("storage"))
+	s := storage.NewStorage()
+	defer s.Close()
+
+	_ = s.LPush("unknown", 1)
+	assert.Contains(t, b.String(), `"msg":"Key 'unknown' not found"`)
+}
+
+func TestEvictionNone(t *testing.T) {
+	s := storage.NewStorage(storage.WithMaxMemory(200))
+	defer s.Close()
+	assert.Nil(t, s.Set("k1", strings.Repeat("v", 100), 0))
+	assert.Nil(t, s.Set("k2", strings.Repeat("v", 100), 0))
+	assert.Equal(t, storage.ErrOutOfMemory, s.Set("k3", "v", 0))
+	assert.Equal(t, storage.ErrOutOfMemory, s.Update("k1", "v", 0))
+
+	// Deletes free memory
+	used := s.MemoryUsed()
+	s.Delete("k2")
+	assert.True(t, s.MemoryUsed() < used)
+	assert.Nil(t, s.Set("k3", "v", 0))
+}
+
+func TestMemoryUsage(t *testing.T) {
+	s := storage.NewStorage()
+	defer s.Close()
+	assert.Nil(t, s.Set("small", "v", 0))
+	assert.Nil(t, s.Set("big", strings.Repeat("v", 1000), 0))
+	assert.Nil(t, s.LSet("list", "a", "b", 0))
+	assert.Nil(t, s.DSet("dict", "f1", "v1", 0))
+	small, err := s.MemoryUsage("small")
+	assert.Nil(t, err)
+	big, _ := s.MemoryUsage("big")
+	assert.Equal(t, int64(999 - 2), big - small) // Longer value, shorter key
+	_, err = s.MemoryUsage("unknown")
+	assert.Equal(t, storage.ErrNotFound, err)
+
+	// Item size follows list and dict changes
+	list, _ := s.MemoryUsage("list")
+	assert.Nil(t, s.LPush("list", "c"))
+	grown, _ := s.MemoryUsage("list")
+	assert.True(t, grown > list)
+	_, _ = s.LPop("list")
+	shrunk, _ := s.MemoryUsage("list")
+	assert.Equal(t, list, shrunk)
+	dict, _ := s.MemoryUsage("dict")
+	assert.Nil(t, s.DAdd("dict", "f2", "v2"))
+	s.DDel("dict", "f2")
+	shrunk, _ = s.MemoryUsage("dict")
+	assert.Equal(t, dict, shrunk)
+
+	// Total is sum of items
+	var sum int64
+	for _, key := range []string{"small", "big", "list", "dict"} {
+		n, _ := s.MemoryUsage(key)
+		sum += n
+	}
+	assert.Equal(t, sum, s.MemoryUsed())
+	assert.Equal(t, sum, s.Stats().Memory)
+	s.Delete("big")
+	assert.Equal(t, sum - big, s.MemoryUsed())
+}
+
+func TestBiggestKeys(t *testing.T) {
+	s := storage.NewStorage()
+	defer s.Close()
+	for i := 1; i <= 5; i++ {
+		assert.Nil(t, s.Set(_s("k%d", i), strings.Repeat("v", i * 10), 0))
+	}
+	assert.Nil(t, s.Set("k0", strings.Repeat("v", 50), 0))
+	top, err := s.BiggestKeys(3)
+	assert.Nil(t, err)
+	keys := []string{}
+	for _, ks := range top {
+		keys = append(keys, ks.Key)
+	}
+	assert.Equal(t, []string{"k0", "k5", "k4"}, keys)
+	size, _ := s.MemoryUsage("k4")
+	assert.Equal(t, size, top[2].Size)
+
+	top, _ = s.BiggestKeys(10)
+	assert.Equal(t, 6, len(top))
+	top, _ = s.BiggestKeys(0)
+	assert.Equal(t, 0, len(top))
+}
+
+func TestCompression(t *testing.T) {
+	s := storage.NewStorage(storage.WithCompression(100))
+	defer s.Close()
+	blob := strings.Repeat(`{"name":"value"},`, 100)
+	assert.Nil(t, s.Set("blob", blob, 0))
+	assert.Nil(t, s.Set("bytes", []byte(blob), 0))
+	assert.Nil(t, s.Set("short", "value", 0))
+
+	// Values decompressed on read with original type
+	v, err := s.Get("blob")
+	assert.Nil(t, err)
+	assert.Equal(t, blob, v)
+	v, _ = s.Get("bytes")
+	assert.Equal(t, []byte(blob), v)
+	typ, _ := s.Type("blob")
+	assert.Equal(t, storage.TypeString, typ)
+	size, _ := s.MemoryUsage("blob")
+	assert.True(t, size < int64(len(blob)))
+
+	st := s.Stats()
+	assert.Equal(t, 2, st.Compressed)
+	assert.Equal(t, int64(2 * len(blob)), st.OriginalSize)
+	assert.True(t, st.CompressionRatio() > 10)
+
+	// Stats follow replaced, renamed and deleted values
+	assert.Nil(t, s.Update("bytes", "v", 0))
+	assert.Nil(t, s.Rename("blob", "blob2"))
+	v, _ = s.Get("blob2")
+	assert.Equal(t, blob, v)
+	assert.Equal(t, 1, s.Stats().Compressed)
+	s.Delete("blob2")
+	st = s.Stats()
+	assert.Equal(t, 0, st.Compressed)
+	assert.Equal(t, 0.0, st.CompressionRatio())
+
+	// Values are compressed by every setter
+	assert.Nil(t, s.SetTagged("tagged", blob, 0, "t"))
+	assert.Nil(t, s.SetSoft("soft", blob, 10, 0))
+	v, err = s.GetOrLoad("loaded", 0, func(key string) (interface{}, error) {
+		return blob, nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, blob, v)
+	assert.Equal(t, 3, s.Stats().Compressed)
+	v, _ = s.Get("loaded")
+	assert.Equal(t, blob, v)
+	s.InvalidateTag("t")
+	s.Delete("soft")
+	s.Delete("loaded")
+
+	// Disabled compression affects new values only
+	assert.Nil(t, s.Set("blob", blob, 0))
+	s.SetCompression(0)
+	assert.Nil(t, s.Set("plain", blob, 0))
+	assert.Equal(t, 1, s.Stats().Compressed)
+	size, _ = s.MemoryUsage("plain")
+	assert.True(t, size > int64(len(blob)))
+}
+
+func TestEvictionLRU(t *testing.T) {
+	s := storage.NewStorage(storage.WithMaxMemory(500),
+		storage.WithEvictionPolicy(storage.EvictAllKeysLRU))
+	defer s.Close()
+	sub, _ := s.Subscribe("*", storage.EventEvicted)
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, s.Set(_s("k%d", i), strings.Repeat("v", 50), 0))
+	}
+	_, _ = s.Get("k0") // k1 is least recently used now
+	assert.Nil(t, s.Set("k4", strings.Repeat("v", 50), 0))
+
+	assert.Equal(t, 4, s.Len())
+	assert.Equal(t, 0, s.Exists("k1"))
+	assert.Equal(t, storage.Event{Type: storage.EventEvicted, Key: "k1"}, <-sub.C)
+	assert.Equal(t, int64(1), s.Stats().Evicted)
+	assert.True(t, s.MemoryUsed() <= 500)
+}
+
+func TestEvictionVolatileTTL(t *testing.T) {
+	s := storage.NewStorage(storage.WithMaxMemory(300),
+		storage.WithEvictionPolicy(storage.EvictVolatileTTL))
+	defer s.Close()
+	_ = s.Set("soon", strings.Repeat("v", 50), 100)
+	_ = s.Set("late", strings.Repeat("v", 50), 200)
+	_ = s.Set("persistent", strings.Repeat("v", 50), 0)
+	assert.Equal(t, 2, s.Len())
+	assert.Equal(t, 0, s.Exists("soon"))
+
+	// Only keys with expire evicted, so usage stays over limit
+	s.SetEvictionPolicy(storage.EvictVolatileLRU)
+	_ = s.Set("other", strings.Repeat("v", 200), 0)
+	assert.Equal(t, 2, s.Len())
+	assert.Equal(t, 2, s.Exists("persistent", "other"))
+
+	p, err := storage.ParseEvictionPolicy("allkeys-random")
+	assert.Nil(t, err)
+	assert.Equal(t, storage.EvictAllKeysRandom, p)
+	_, err = storage.ParseEvictionPolicy("unknown")
+	assert.Equal(t, storage.ErrBadPolicy, err)
+}
+
+func TestStorageOptions(t *testing.T) {
+	var b bytes.Buffer
+	clock := storage.NewFakeClock(time.Now().Add(-time.Hour))
+	s := storage.NewStorage(storage.WithClock(clock),
+		storage.WithTickInterval(10 * time.Millisecond),
+		storage.WithLogger(lib.NewLoggerOutput("db1", lib.NewOutput(&b, lib.TextEncoder{}, lib.LOG_DEBUG))))
+	defer s.Close()
+
+	// TTL counted by storage clock
+	_ = s.Set("k", "v", 10)
+	exp, _ := s.GetExpire("k")
+	assert.Equal(t, int(clock.Now().Unix()) + 10, exp)
+	ttl, _ := s.TTL("k")
+	assert.Equal(t, 10, ttl)
+
+	_ = s.LPush("unknown", 1)
+	assert.Contains(t, b.String(), "| db1 |")
+}
+
+type typedUser struct {
+	Name string
+	Age  int
+}
+
+func TestTyped(t *testing.T) {
+	s := storage.NewStorage()
+	defer s.Close()
+	users := storage.NewTyped[typedUser](s, nil)
+	assert.Nil(t, users.Set("u1", typedUser{"Ann", 30}, 0))
+	u, err := users.Get("u1")
+	assert.Nil(t, err)
+	assert.Equal(t, "Ann", u.Name)
+	assert.Nil(t, users.Update("u1", typedUser{"Ann", 31}, 0))
+	u, _ = users.Get("u1")
+	assert.Equal(t, 31, u.Age)
+
+	// Stored as is without codec
+	raw, _ := s.Get("u1")
+	assert.Equal(t, typedUser{"Ann", 31}, raw)
+
+	// Other types rejected
+	_ = s.Set("str", "value", 0)
+	_, err = users.Get("str")
+	assert.Equal(t, storage.ErrBadType, err)
+	_, err = users.Get("unknown")
+	assert.Equal(t, storage.ErrNotFound, err)
+	users.Delete("u1")
+	assert.Equal(t, 0, s.Exists("u1"))
+}
+
+func TestTypedCodec(t *testing.T) {
+	s := storage.NewStorage()
+	defer s.Close()
+	users := storage.NewTyped[typedUser](s, storage.JSONCodec[typedUser]{})
+	assert.Nil(t, users.Set("u1", typedUser{"Bob", 20}, 0))
+	raw, _ := s.Get("u1")
+	assert.Equal(t, `{"Name":"Bob","Age":20}`, raw)
+
+	// Strings set by other clients decoded
+	_ = s.Set("u2", `{"Name":"Eve","Age":25}`, 0)
+	u, err := users.Get("u2")
+	assert.Nil(t, err)
+	assert.Equal(t, typedUser{"Eve", 25}, u)
+	_ = s.Set("bad", "{", 0)
+	_, err = users.Get("bad")
+	assert.NotNil(t, err)
+
+	// Lists and dicts
+	nums := storage.NewTypedList[int](s, storage.IntCodec{})
+	assert.Nil(t, nums.LSet("l1", 0, 1, 2))
+	assert.Nil(t, nums.LPush("l1", 3))
+	n, err := nums.LPop("l1")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+
+	names := storage.NewTypedDict[string](s, storage.StringCodec{})
+	assert.Nil(t, names.DSet("d1", map[string]string{"a": "x"}, 0))
+	assert.Nil(t, names.DAdd("d1", "b", "y"))
+	v, err := names.DGet("d1", "b")
+	assert.Nil(t, err)
+	assert.Equal(t, "y", v)
+	names.DDel("d1", "a")
+	_, err = names.DGet("d1", "a")
+	assert.Equal(t, storage.ErrNotFound, err)
+}
+
+// Loader /////////////////////////////////////////////////////////////////////
+
+func TestGetOrLoad(t *testing.T) {
+	s := storage.NewStorage()
+	defer s.Close()
+	var calls int32
+	started, release := make(chan struct{}, 10), make(chan struct{})
+	load := func(key string) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		started <- struct{}{}
+		<-release
+		return "loaded_" + key, nil
+	}
+
+	// Concurrent callers share one load
+	var wg sync.WaitGroup
+	results := make(chan interface{}, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := s.GetOrLoad("k1", 0, load)
+			assert.Nil(t, err)
+			results <- v
+		}()
+	}
+	<-started // Callers coming later get loaded value from Storage
+	close(release)
+	wg.Wait()
+	close(results)
+	for v := range results {
+		assert.Equal(t, "loaded_k1", v)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// Loaded value cached
+	v, _ := s.Get("k1")
+	assert.Equal(t, "loaded_k1", v)
+	v, _ = s.GetOrLoad("k1", 0, load)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	n, err := storage.NewTyped[int](s, storage.IntCodec{}).GetOrLoad("n",
+		0, func(string) (int, error) { return 42, nil })
+	assert.Nil(t, err)
+	assert.Equal(t, 42, n)
+	v, _ = s.Get("n")
+	assert.Equal(t, "42", v)
+}
+
+func TestGetOrLoadErrorTTL(t *testing.T) {
+	s, clock := newFakeStorage(storage.WithErrorTTL(5 * time.Second))
+	defer s.Close()
+	calls := 0
+	errDB := fmt.Errorf("db down")
+	load := func(key string) (interface{}, error) {
+		calls++
+		if calls == 1 {
+			return nil, errDB
+		}
+		return "v", nil
+	}
+
+	// Error cached for ErrorTTL
+	_, err := s.GetOrLoad("k", 0, load)
+	assert.Equal(t, errDB, err)
+	_, err = s.GetOrLoad("k", 0, load)
+	assert.Equal(t, errDB, err)
+	assert.Equal(t, 1, calls)
+
+	clock.Advance(5 * time.Second)
+	v, err := s.GetOrLoad("k", 0, load)
+	assert.Nil(t, err)
+	assert.Equal(t, "v", v)
+	assert.Equal(t, 2, calls)
+}
+
+func TestGetOrLoadRefreshAhead(t *testing.T) {
+	s, clock := newFakeStorage(storage.WithRefreshAhead(10 * time.Second))
+	defer s.Close()
+	var version int32
+	load := func(key string) (interface{}, error) {
+		return int(atomic.AddInt32(&version, 1)), nil
+	}
+	v, _ := s.GetOrLoad("k", 60, load)
+	assert.Equal(t, 1, v)
+
+	// Not refreshed far from expire
+	clock.Advance(40 * time.Second)
+	v, _ = s.GetOrLoad("k", 60, load)
+	assert.Equal(t, 1, v)
+
+	// Current value returned while refreshed in background
+	sub, _ := s.Subscribe("k", storage.EventUpdate)
+	clock.Advance(15 * time.Second)
+	v, _ = s.GetOrLoad("k", 60, load)
+	assert.Equal(t, 1, v)
+	checkEvent(t, sub, storage.Event{Type: storage.EventUpdate, Key: "k"})
+	v, _ = s.Get("k")
+	assert.Equal(t, 2, v)
+	ttl, _ := s.TTL("k")
+	assert.Equal(t, 60, ttl)
+}
+
+func TestSoftTTL(t *testing.T) {
+	var version int32
+	release := make(chan struct{}, 1)
+	load := func(key string) (interface{}, error) {
+		<-release
+		return int(atomic.AddInt32(&version, 1)) + 1, nil
+	}
+	s, clock := newFakeStorage(storage.WithLoader(load))
+	defer s.Close()
+	assert.Equal(t, storage.ErrBadTTL, s.SetSoft("k", 1, 0, 60))
+	assert.Equal(t, storage.ErrBadTTL, s.SetSoft("k", 1, 60, 60))
+	assert.Nil(t, s.SetSoft("k", 1, 10, 60))
+
+	// Fresh before soft TTL
+	v, stale, err := s.GetStale("k")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, v)
+	assert.False(t, stale)
+
+	// Stale value returned, one refresh started by many reads
+	sub, _ := s.Subscribe("k", storage.EventUpdate)
+	clock.Advance(10 * time.Second)
+	for i := 0; i < 5; i++ {
+		v, stale, err = s.GetStale("k")
+		assert.Nil(t, err)
+		assert.Equal(t, 1, v)
+		assert.True(t, stale)
+	}
+	release <- struct{}{}
+	checkEvent(t, sub, storage.Event{Type: storage.EventUpdate, Key: "k"})
+	assert.Equal(t, int32(1), atomic.LoadInt32(&version))
+	assert.Equal(t, int64(5), s.Stats().Stale)
+
+	// Refreshed value keeps soft and hard TTL
+	v, stale, _ = s.GetStale("k")
+	assert.Equal(t, 2, v)
+	assert.False(t, stale)
+	ttl, _ := s.TTL("k")
+	assert.Equal(t, 60, ttl)
+
+	// Hard TTL deletes key as usual
+	s.SetLoader(nil)
+	clock.Advance(20 * time.Second)
+	v, _ = s.Get("k")
+	assert.Equal(t, 2, v)
+	clock.Advance(40 * time.Second)
+	_, err = s.Get("k")
+	assert.Equal(t, storage.ErrNotFound, err)
+
+	// Renamed key keeps soft TTL
+	assert.Nil(t, s.SetSoft("r", 1, 10, 60))
+	assert.Nil(t, s.Rename("r", "r2"))
+	clock.Advance(10 * time.Second)
+	_, stale, err = s.GetStale("r2")
+	assert.Nil(t, err)
+	assert.True(t, stale)
+	ttl, _ = s.TTL("r2")
+	assert.Equal(t, 50, ttl)
+}
+
+func TestTags(t *testing.T) {
+	s, clock := newFakeStorage()
+	defer s.Close()
+	assert.Nil(t, s.SetTagged("user:42:profile", "p", 0, "user:42"))
+	assert.Nil(t, s.SetTagged("user:42:orders", "o", 10, "user:42", "orders"))
+	assert.Nil(t, s.SetTagged("user:43:orders", "o", 0, "orders"))
+	assert.Nil(t, s.Set("other", "v", 0))
+	tags, err := s.Tags("user:42:orders")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"orders", "user:42"}, tags)
+
+	// Tags kept by Update and Rename
+	assert.Nil(t, s.Update("user:42:profile", "p2", 0))
+	assert.Nil(t, s.Rename("user:42:profile", "user:42:info"))
+	tags, _ = s.Tags("user:42:info")
+	assert.Equal(t, []string{"user:42"}, tags)
+
+	n, err := s.InvalidateTag("user:42")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, 0, s.Exists("user:42:info", "user:42:orders"))
+	n, _ = s.InvalidateTag("user:42")
+	assert.Equal(t, 0, n)
+
+	// Expired keys aren't counted
+	assert.Nil(t, s.SetTagged("user:44:orders", "o", 10, "orders"))
+	clock.Advance(10 * time.Second)
+	n, _ = s.InvalidateTag("orders")
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 1, s.Len())
+}
+
+func TestDeleteByPrefix(t *testing.T) {
+	s := storage.NewStorage()
+	defer s.Close()
+	for _, key := range []string{"user:1", "user:10", "user:100", "user:2", "users", "u", "admin:1"} {
+		assert.Nil(t, s.Set(key, "v", 0))
+	}
+	sub, _ := s.Subscribe("user:2", storage.EventDelete)
+	n, err := s.DeleteByPrefix("user:1")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	keys, _ := s.Keys("*")
+	assert.Equal(t, []string{"admin:1", "u", "user:2", "users"}, keys)
+
+	n, _ = s.DeleteByPrefix("user")
+	assert.Equal(t, 2, n)
+	checkEvent(t, sub, storage.Event{Type: storage.EventDelete, Key: "user:2"})
+	n, _ = s.DeleteByPrefix("x")
+	assert.Equal(t, 0, n)
+
+	// Index follows deleted and added keys
+	s.Delete("u")
+	assert.Nil(t, s.Set("user:3", "v", 0))
+	n, _ = s.DeleteByPrefix("u")
+	assert.Equal(t, 1, n)
+	n, _ = s.DeleteByPrefix("")
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 0, s.Len())
+
+	// Func deletes only keys it accepts
+	for _, key := range []string{"user:1", "user:2", "user:22"} {
+		assert.Nil(t, s.Set(key, "v", 0))
+	}
+	n, err = s.DeleteByPrefixFunc("user:", func(key string) bool { return len(key) == 6 })
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	keys, _ = s.Keys("*")
+	assert.Equal(t, []string{"user:22"}, keys)
+}
+
+func TestSoftTTLPanic(t *testing.T) {
+	panicked := make(chan struct{}, 1)
+	load := func(key string) (interface{}, error) {
+		panicked <- struct{}{}
+		panic("db down")
+	}
+	s, clock := newFakeStorage(storage.WithLoader(load))
+	defer s.Close()
+	assert.Nil(t, s.SetSoft("k", 1, 10, 60))
+
+	// Stale value still returned, panic doesn't crash process
+	clock.Advance(10 * time.Second)
+	v, err := s.Get("k")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, v)
+	<-panicked
+
+	// Failed refresh finishes, so one of next reads starts new one
+	var stale bool
+	assert.Eventually(t, func() bool {
+		v, stale, err = s.GetStale("k")
+		select {
+		case <-panicked:
+			return true
+		default:
+			return false
+		}
+	}, time.Second, time.Millisecond, "Refresh not started again")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, v)
+	assert.True(t, stale)
+}
+
+func TestGetOrLoadRefreshAheadPanic(t *testing.T) {
+	s, clock := newFakeStorage(storage.WithRefreshAhead(10 * time.Second))
+	defer s.Close()
+	var calls int32
+	panicked := make(chan struct{}, 1)
+	load := func(key string) (interface{}, error) {
+		if atomic.AddInt32(&calls, 1) == 2 {
+			panicked <- struct{}{}
+			panic("db down")
+		}
+		return "v", nil
+	}
+	v, _ := s.GetOrLoad("k", 60, load)
+	assert.Equal(t, "v", v)
+
+	// Panic in background refresh doesn't crash process
+	clock.Advance(55 * time.Second)
+	v, err := s.GetOrLoad("k", 60, load)
+	assert.Nil(t, err)
+	assert.Equal(t, "v", v)
+	<-panicked
+
+	// Failed refresh finishes, so one of next reads starts new one
+	sub, _ := s.Subscribe("k", storage.EventUpdate)
+	assert.Eventually(t, func() bool {
+		v, _ = s.GetOrLoad("k", 60, load)
+		return atomic.LoadInt32(&calls) == 3
+	}, time.Second, time.Millisecond, "Refresh not started again")
+	assert.Equal(t, "v", v)
+	checkEvent(t, sub, storage.Event{Type: storage.EventUpdate, Key: "k"})
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
 }
 
 // Lists //////////////////////////////////////////////////////////////////////
 
 func TestSetTTLSuccess(t *testing.T) {
-	s := storage.NewStorage()
+	s, clock := newFakeStorage()
+	defer s.Close()
 	key, item, _ := makeTestItem()
 	ttl := 2
 
@@ -122,7 +1101,7 @@ func TestSetTTLSuccess(t *testing.T) {
 
 	// Set new TTL
 	newTtl := 4
-	newTtlStamp := storage.MakeTTLStamp(newTtl)
+	newTtlStamp := int(clock.Now().Unix()) + newTtl
 	err := s.SetTTL(key, newTtl)
 	assert.Nil(t, err, "SetTTL failed")
 
@@ -134,6 +1113,7 @@ func TestSetTTLSuccess(t *testing.T) {
 func TestLSetSuccess(t *testing.T) {
 	// Prepare
 	s := storage.NewStorage()
+	defer s.Close()
 	keyOk, _, ttl := makeTestItem()
 	valOk := []string{ "value1", "value2", "value3" }
 
@@ -163,6 +1143,7 @@ func TestLSetSuccess(t *testing.T) {
 func TestLPushSuccess(t *testing.T) {
 	// Prepare
 	s := storage.NewStorage()
+	defer s.Close()
 	keyOk, _, ttl := makeTestItem()
 	valOk := []int{10}
 
@@ -203,6 +1184,7 @@ func TestLPushSuccess(t *testing.T) {
 func TestDSetSuccess(t *testing.T) {
 	// Prepare
 	s := storage.NewStorage()
+	defer s.Close()
 	rkey, _, ttl := makeTestItem()
 	k1, k2, k3 := "key1",	"key2",   "key3"
 	v1, v2, v3 := "value1", "value2", "value3"
@@ -221,6 +1203,7 @@ func TestDSetSuccess(t *testing.T) {
 
 func TestDAddSuccess(t *testing.T) {
 	s := storage.NewStorage()
+	defer s.Close()
 	rkey, _, ttl := makeTestItem()
 	k1, k2, k3 := "k1", "k2", "k3"
 	v1, v2, v3 := 10, 23, 123
@@ -240,6 +1223,7 @@ func TestDAddSuccess(t *testing.T) {
 
 func TestDDelSuccess(t *testing.T) {
 	s := storage.NewStorage()
+	defer s.Close()
 	rkey, _, ttl := makeTestItem()
 	k1, k2, k3 := "k1", "k2", "k3"
 	v1, v2, v3 := 10, 23, 123
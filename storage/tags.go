@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"sort"
+)
+
+// SetTagged is like Set, but key gets tags, so it can be deleted together
+// with other keys of the same tag by InvalidateTag. Tags are kept when
+// value replaced by Update or refreshed by loader
+func (s *Storage) SetTagged(key string, val interface{}, ttl int, tags ...string) error {
+	val = s.compress(val)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	s.dropExpiredUnsafe(key)
+	if _, found := s.data[key]; found {
+		return ErrAlreadyExists
+	}
+	if err := s.setUnsafe(key, val, ttl); err != nil {
+		return err
+	}
+	s.tagUnsafe(key, tags)
+	return nil
+}
+
+// Tags returns sorted tags of key
+func (s *Storage) Tags(key string) ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	el, found := s.getUnsafe(key)
+	if !found {
+		return nil, ErrNotFound
+	}
+	tags := append([]string{}, itemTags(el)...)
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// InvalidateTag deletes all keys with tag and returns number of deleted
+// keys. Keys are found by tag index without scanning all keys
+func (s *Storage) InvalidateTag(tag string) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return 0, ErrClosed
+	}
+	keys := make([]string, 0, len(s.tags[tag]))
+	for key := range s.tags[tag] {
+		keys = append(keys, key)
+	}
+	return s.deleteKeysUnsafe(keys), nil
+}
+
+// DeleteByPrefix deletes all keys starting with prefix and returns number
+// of deleted keys. Keys are found by prefix index without scanning all
+// keys
+func (s *Storage) DeleteByPrefix(prefix string) (int, error) {
+	return s.DeleteByPrefixFunc(prefix, nil)
+}
+
+// DeleteByPrefixFunc is like DeleteByPrefix, but deletes only keys for
+// which f returns true. Nil f deletes all keys starting with prefix. f is
+// called with Storage locked, so it must not use Storage
+func (s *Storage) DeleteByPrefixFunc(prefix string, f func(key string) bool) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return 0, ErrClosed
+	}
+	keys := s.prefixes.keys(prefix)
+	if f != nil {
+		matched := keys[:0]
+		for _, key := range keys {
+			if f(key) {
+				matched = append(matched, key)
+			}
+		}
+		keys = matched
+	}
+	return s.deleteKeysUnsafe(keys), nil
+}
+
+// tagUnsafe adds tags to existing key
+func (s *Storage) tagUnsafe(key string, tags []string) {
+	it, ok := s.data[key].(*Item)
+	if !ok {
+		return
+	}
+	for _, tag := range tags {
+		if _, found := s.tags[tag][key]; found {
+			continue
+		}
+		it.tags = append(it.tags, tag)
+		s.addTagUnsafe(tag, key)
+		s.resizeUnsafe(it, tagsSize([]string{tag}))
+	}
+}
+
+// deleteKeysUnsafe deletes keys notifying subscribers and returns number
+// of deleted keys. Expired keys aren't counted
+func (s *Storage) deleteKeysUnsafe(keys []string) int {
+	n := 0
+	now := s.now()
+	for _, key := range keys {
+		el, found := s.data[key]
+		if !found {
+			continue
+		}
+		if expired(el, now) {
+			s.expiredUnsafe(key)
+			continue
+		}
+		s.deleteUnsafe(key)
+		s.notify(EventDelete, key, "")
+		n++
+	}
+	return n
+}
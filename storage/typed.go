@@ -0,0 +1,212 @@
+package storage
+
+// Typed is type safe wrapper of Storage for values of type V. Without
+// codec values are stored as is. With codec they are stored encoded as
+// strings, so values set by Typed can be read over TCP and values set over
+// TCP can be read by Typed. Keys holding other types return ErrBadType
+type Typed[V any] struct {
+	s     *Storage
+	codec Codec[V]
+}
+
+// NewTyped wraps s. Codec can be nil
+func NewTyped[V any](s *Storage, codec Codec[V]) *Typed[V] {
+	return &Typed[V]{s: s, codec: codec}
+}
+
+// Storage returns wrapped Storage
+func (t *Typed[V]) Storage() *Storage {
+	return t.s
+}
+
+// Get returns value of key
+func (t *Typed[V]) Get(key string) (V, error) {
+	raw, err := t.s.Get(key)
+	if err != nil {
+		var zero V
+		return zero, err
+	}
+	return decodeValue(t.codec, raw)
+}
+
+// Set sets value of key like Storage.Set
+func (t *Typed[V]) Set(key string, v V, ttl int) error {
+	raw, err := encodeValue(t.codec, v)
+	if err != nil {
+		return err
+	}
+	return t.s.Set(key, raw, ttl)
+}
+
+// Update updates value of key like Storage.Update
+func (t *Typed[V]) Update(key string, v V, ttl int) error {
+	raw, err := encodeValue(t.codec, v)
+	if err != nil {
+		return err
+	}
+	return t.s.Update(key, raw, ttl)
+}
+
+// Delete deletes key
+func (t *Typed[V]) Delete(key string) {
+	t.s.Delete(key)
+}
+
+// SetTagged sets value of key with tags like Storage.SetTagged
+func (t *Typed[V]) SetTagged(key string, v V, ttl int, tags ...string) error {
+	raw, err := encodeValue(t.codec, v)
+	if err != nil {
+		return err
+	}
+	return t.s.SetTagged(key, raw, ttl, tags...)
+}
+
+// GetStale returns value of key and reports that it's stale like
+// Storage.GetStale
+func (t *Typed[V]) GetStale(key string) (V, bool, error) {
+	raw, stale, err := t.s.GetStale(key)
+	if err != nil {
+		var zero V
+		return zero, false, err
+	}
+	v, err := decodeValue(t.codec, raw)
+	return v, stale, err
+}
+
+// SetSoft sets value of key with soft TTL like Storage.SetSoft
+func (t *Typed[V]) SetSoft(key string, v V, softTTL, ttl int) error {
+	raw, err := encodeValue(t.codec, v)
+	if err != nil {
+		return err
+	}
+	return t.s.SetSoft(key, raw, softTTL, ttl)
+}
+
+// GetOrLoad returns value of key loading missing one like
+// Storage.GetOrLoad
+func (t *Typed[V]) GetOrLoad(key string, ttl int, load func(key string) (V, error)) (V, error) {
+	raw, err := t.s.GetOrLoad(key, ttl, func(key string) (interface{}, error) {
+		v, err := load(key)
+		if err != nil {
+			return nil, err
+		}
+		return encodeValue(t.codec, v)
+	})
+	if err != nil {
+		var zero V
+		return zero, err
+	}
+	return decodeValue(t.codec, raw)
+}
+
+// TypedList is type safe wrapper of Storage lists with elements of type V
+type TypedList[V any] struct {
+	s     *Storage
+	codec Codec[V]
+}
+
+// NewTypedList wraps s. Codec can be nil
+func NewTypedList[V any](s *Storage, codec Codec[V]) *TypedList[V] {
+	return &TypedList[V]{s: s, codec: codec}
+}
+
+// LSet creates list of values like Storage.LSet
+func (t *TypedList[V]) LSet(key string, ttl int, vals ...V) error {
+	args := make([]interface{}, 0, len(vals) + 1)
+	for _, v := range vals {
+		raw, err := encodeValue(t.codec, v)
+		if err != nil {
+			return err
+		}
+		args = append(args, raw)
+	}
+	return t.s.LSet(key, append(args, ttl)...)
+}
+
+// LPush pushes value to list
+func (t *TypedList[V]) LPush(key string, v V) error {
+	raw, err := encodeValue(t.codec, v)
+	if err != nil {
+		return err
+	}
+	return t.s.LPush(key, raw)
+}
+
+// LPop pops last value of list
+func (t *TypedList[V]) LPop(key string) (V, error) {
+	raw, err := t.s.LPop(key)
+	if err != nil {
+		var zero V
+		return zero, err
+	}
+	return decodeValue(t.codec, raw)
+}
+
+// TypedDict is type safe wrapper of Storage dicts with fields of type V
+type TypedDict[V any] struct {
+	s     *Storage
+	codec Codec[V]
+}
+
+// NewTypedDict wraps s. Codec can be nil
+func NewTypedDict[V any](s *Storage, codec Codec[V]) *TypedDict[V] {
+	return &TypedDict[V]{s: s, codec: codec}
+}
+
+// DSet creates dict from fields like Storage.DSet
+func (t *TypedDict[V]) DSet(key string, fields map[string]V, ttl int) error {
+	m := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		raw, err := encodeValue(t.codec, v)
+		if err != nil {
+			return err
+		}
+		m[k] = raw
+	}
+	return t.s.DSet(key, m, ttl)
+}
+
+// DGet returns field of dict
+func (t *TypedDict[V]) DGet(key, field string) (V, error) {
+	raw, err := t.s.DGet(key, field)
+	if err != nil {
+		var zero V
+		return zero, err
+	}
+	return decodeValue(t.codec, raw)
+}
+
+// DAdd sets field of dict
+func (t *TypedDict[V]) DAdd(key, field string, v V) error {
+	raw, err := encodeValue(t.codec, v)
+	if err != nil {
+		return err
+	}
+	return t.s.DAdd(key, field, raw)
+}
+
+// DDel deletes field of dict
+func (t *TypedDict[V]) DDel(key, field string) {
+	t.s.DDel(key, field)
+}
+
+// encodeValue returns value stored in Storage
+func encodeValue[V any](codec Codec[V], v V) (interface{}, error) {
+	if codec == nil {
+		return v, nil
+	}
+	return codec.Encode(v)
+}
+
+// decodeValue converts stored value to V. Strings are decoded by codec if
+// it set, other values must have type V
+func decodeValue[V any](codec Codec[V], raw interface{}) (V, error) {
+	if str, ok := raw.(string); ok && codec != nil {
+		return codec.Decode(str)
+	}
+	if v, ok := raw.(V); ok {
+		return v, nil
+	}
+	var zero V
+	return zero, ErrBadType
+}